@@ -6,31 +6,51 @@
 // http://golang.org/src/pkg/image/png/writer.go
 // http://golang.org/src/pkg/image/png/reader.go
 
-package main
+package apng
 
 import (
 	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
 	"encoding/binary"
-	"flag"
+	"errors"
 	"fmt"
 	"hash"
 	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
 	"io"
 	"io/ioutil"
-	"log"
+	"math/bits"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 )
 
 const pngHeader = "\x89PNG\r\n\x1a\n"
-const maxChunkSize = 1024 * 1024 // in byte
+const maxChunkSize = 1024 * 1024 // in byte, the default of EncodeOptions.ChunkSize
+
+// minChunkSize is the smallest EncodeOptions.ChunkSize, room for the chunk,
+// the sequence number and some image data.
+const minChunkSize = 64
 
 type decoder struct {
-	r         io.Reader
+	r         *bufio.Reader
 	crc       hash.Hash32
 	ChunkName string
-	tmp       [maxChunkSize]byte
+	buf       bytes.Buffer // reused for every chunk, grows to the largest chunk read so far
+	tmp       []byte       // the last chunk read: length, chunk type, data and crc
+	header    [8]byte      // length and chunk type of the current chunk
+	skipCRC   bool         // do not verify the crc of the chunks
 }
 
 type FormatError string
@@ -48,32 +68,145 @@ func min(a, b int) int {
 	return b
 }
 
+// parseChunk reads the next chunk into d.tmp and returns its total length.
 func (d *decoder) parseChunk() (uint32, error) {
-	// Read the length and chunk type.
-	_, err := io.ReadFull(d.r, d.tmp[0:8])
+	length, err := d.readChunkHeader()
+	if err != nil {
+		return 0, err
+	}
+	return length, d.readChunkBody(length)
+}
+
+// readChunkHeader reads the length and chunk type of the next chunk and
+// returns the total length of the chunk, including length, chunk type and crc.
+// The data and the crc are left in d.r for readChunkBody, copyChunkData or skipChunkBody.
+func (d *decoder) readChunkHeader() (uint32, error) {
+	_, err := io.ReadFull(d.r, d.header[:])
 	if err != nil {
 		return 0, err
 	}
-	length := binary.BigEndian.Uint32(d.tmp[0:4])
+	length := binary.BigEndian.Uint32(d.header[0:4])
+	if length > 0x7fffffff {
+		return 0, FormatError("chunk length exceeds 2^31-1")
+	}
 
-	d.ChunkName = string(d.tmp[4:8])
+	d.ChunkName = string(d.header[4:8])
 
 	//fmt.Printf("%s length %d\n", d.ChunkName, length)
 
+	d.crc.Reset()
+	d.crc.Write(d.header[4:8])
+	return length + 8 + 4, nil
+}
+
+// verifyCRC compares the crc of the chunk type and data read so far to the crc read from the chunk.
+func (d *decoder) verifyCRC(crc []byte) error {
+	if d.skipCRC || d.crc.Sum32() == binary.BigEndian.Uint32(crc) {
+		return nil
+	}
+	return FormatError("invalid checksum of " + d.ChunkName + " chunk")
+}
+
+// readChunkBody reads the data and crc of the chunk whose header was just read
+// with readChunkHeader, d.tmp is the whole chunk after that.
+func (d *decoder) readChunkBody(length uint32) error {
+	d.buf.Reset()
+	d.buf.Write(d.header[:])
+
 	// Read chunk data and 4 bytes crc checksum
-	_, err = io.ReadFull(d.r, d.tmp[8:length+8+4])
+	_, err := io.CopyN(&d.buf, d.r, int64(length)-8)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
 	if err != nil {
-		return 0, err
+		return err
 	}
-	return length + 8 + 4, nil
+	d.tmp = d.buf.Bytes()
+	if !d.skipCRC {
+		d.crc.Write(d.tmp[8 : length-4])
+	}
+	return d.verifyCRC(d.tmp[length-4 : length])
+}
+
+// copyChunkData copies the data of the chunk whose header was just read with
+// readChunkHeader to w and skips the crc, without holding the chunk in memory.
+func (d *decoder) copyChunkData(w io.Writer, length uint32) error {
+	if !d.skipCRC {
+		w = io.MultiWriter(w, d.crc)
+	}
+	_, err := io.CopyN(w, d.r, int64(length)-12)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	return d.readCRC()
+}
+
+// skipChunkBody skips the data of the chunk whose header was just read with readChunkHeader and checks its crc.
+func (d *decoder) skipChunkBody(length uint32) error {
+	return d.copyChunkData(ioutil.Discard, length)
+}
+
+// appendChunkData appends the next n bytes of chunk data to b.
+func (d *decoder) appendChunkData(b []byte, n int) ([]byte, error) {
+	if cap(b)-len(b) < n {
+		grown := make([]byte, len(b), len(b)+n)
+		copy(grown, b)
+		b = grown
+	}
+	_, err := io.ReadFull(d.r, b[len(b):len(b)+n])
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if !d.skipCRC {
+		d.crc.Write(b[len(b) : len(b)+n])
+	}
+	return b[:len(b)+n], err
+}
+
+// readCRC reads the crc after the data read with appendChunkData and checks it.
+func (d *decoder) readCRC() error {
+	_, err := io.ReadFull(d.r, d.header[:4])
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	return d.verifyCRC(d.header[:4])
+}
+
+// peekChunk returns the length and chunk type of the next chunk without consuming it.
+func (d *decoder) peekChunk() (uint32, string, error) {
+	b, err := d.r.Peek(8)
+	if err != nil {
+		return 0, "", err
+	}
+	return binary.BigEndian.Uint32(b[0:4]), string(b[4:8]), nil
+}
+
+// lastInRun reports whether the IDAT chunk that was just read would be
+// written out on its own: either no IDAT follows it, or the next IDAT
+// would not fit into the same output chunk. buffered is the number of
+// bytes already waiting in the output buffer, length the total length of
+// the current chunk as returned by parseChunk.
+func (d *decoder) lastInRun(buffered int, length uint32, maxlength uint32) bool {
+	nextLength, nextName, err := d.peekChunk()
+	if err != nil || nextName != "IDAT" {
+		return true
+	}
+	return uint32(buffered)+length+nextLength > maxlength
 }
 
 func (d *decoder) checkHeader() error {
-	_, err := io.ReadFull(d.r, d.tmp[:len(pngHeader)])
+	var header [len(pngHeader)]byte
+	_, err := io.ReadFull(d.r, header[:])
 	if err != nil {
 		return err
 	}
-	if string(d.tmp[:len(pngHeader)]) != pngHeader {
+	if string(header[:]) != pngHeader {
 		return FormatError("not a PNG file")
 	}
 	return nil
@@ -84,8 +217,242 @@ type encoder struct {
 	err             error
 	header          [8]byte
 	footer          [4]byte
-	tmp             [maxChunkSize]byte
-	animationChunks uint32 // count animation chunks (fcTL and fdAT), starting with the first fcTL as 0. This is often referred to as SEQUENCE NUMBER
+	tmp             [26]byte // data of the acTL and fcTL chunks
+	seq             [4]byte  // sequence number in front of the fdAT data
+	animationChunks uint32   // count animation chunks (fcTL and fdAT), starting with the first fcTL as 0. This is often referred to as SEQUENCE NUMBER
+	compatibility   Compatibility
+	width, height   int             // canvas size, the IHDR dimensions of the first frame
+	bitDepth        uint8           // IHDR bit depth of the first frame
+	colorType       uint8           // IHDR color type of the first frame
+	skipCRC         bool            // do not verify the crc of the input chunks
+	frames          int             // number of fcTL chunks written
+	pending         *frameControl   // fcTL that is written in front of the first fdAT of its frame
+	seeker          io.WriteSeeker  // w if it is an io.WriteSeeker, to correct the acTL chunk
+	actl            int64           // position of the acTL chunk in seeker
+	transcode       bool            // convert frames of another bit depth or color type
+	recompress      bool            // compress the image data again with level
+	level           int             // zlib compression level
+	plte, trns      []byte          // PLTE and tRNS data of the first frame, for transcoding to color type 3
+	prepared        *preparedFrame  // if not nil the fdAT data is collected here instead of being written
+	chunkSize       int             // size up to which IDAT and fdAT chunks are filled, maxChunkSize if 0
+	ctx             context.Context // checked between the chunks, may be nil
+	dedup           bool            // merge frames with the same image data as the frame before
+	digest          hash.Hash       // if not nil the IDAT data is added to it
+	last            []byte          // digest of the image data of the last frame that was written
+	lastFC          *frameControl   // fcTL of the last frame that was written, nil if a frame cannot be merged into it
+	lastFCTL        int64           // position of that fcTL chunk in seeker
+	lastSeq         uint32          // sequence number of that fcTL chunk
+	subFrames       bool            // frames may be smaller than the canvas
+}
+
+// preparedFrame is a frame that was read in advance, its fdAT chunks get
+// their sequence numbers when they are written.
+type preparedFrame struct {
+	fc     *frameControl // nil if the frame has no image data
+	chunks [][]byte      // fdAT data without the sequence number
+	digest []byte        // digest of the image data, for EncodeOptions.MergeDuplicates
+	err    error
+}
+
+// DisposeOp is the dispose_op of a frame, it says what happens to the frame area
+// before the next frame is rendered.
+type DisposeOp uint8
+
+const (
+	DisposeOpNone       DisposeOp = iota // the frame area stays as it is
+	DisposeOpBackground                  // the frame area is cleared to fully transparent black
+	DisposeOpPrevious                    // the frame area is reverted to what it was before this frame
+)
+
+// BlendOp is the blend_op of a frame, it says how the frame is rendered onto the canvas.
+type BlendOp uint8
+
+const (
+	BlendOpSource BlendOp = iota // the frame replaces the frame area, including alpha
+	BlendOpOver                  // the frame is alpha composited over the frame area
+)
+
+// frameControl is the content of a fcTL chunk.
+type frameControl struct {
+	width, height    int
+	xOffset, yOffset int
+	delayNum         uint16
+	delayDen         uint16
+	disposeOp        DisposeOp
+	blendOp          BlendOp
+}
+
+// Delay is the display duration of a frame, Num/Den seconds.
+// If Den is 0, it is treated as 100 (Num is in 1/100ths of a second) as in the spec.
+type Delay struct {
+	Num, Den uint16
+}
+
+// Rational is the fraction Num/Den.
+type Rational struct {
+	Num, Den uint32
+}
+
+// EncodeOptions are the encoding parameters.
+type EncodeOptions struct {
+	// DelayDenominator is the frame delay fraction denominator used for all frames.
+	// The delays passed to the encoder are the numerators, e.g. a denominator of 30
+	// with the delays [1, 1, 2] means 1/30, 1/30 and 2/30 seconds.
+	// If it is 0, it is treated as 100 (the delays are 1/100ths of a second) as in the spec.
+	// It applies to every frame of the entry points that take the delays as
+	// numbers, there is no per-frame override. A fraction for every frame is
+	// given with EncodeDelays instead, which does not use DelayDenominator.
+	DelayDenominator uint16
+
+	// TimeBase is the duration of one delay unit in seconds, e.g. {1001, 24000} for
+	// 23.976 fps video where every delay is a number of video frames. If TimeBase.Den
+	// is not 0 it replaces DelayDenominator and each fcTL gets the reduced fraction
+	// delay*TimeBase, which is rounded to the closest fraction that fits if it
+	// does not fit into 16 bits.
+	TimeBase Rational
+
+	// SnapTimeBase, if not 0, rounds the delays given in TimeBase to multiples of
+	// 1/SnapTimeBase seconds, e.g. 30 writes every fcTL with a denominator of 30.
+	// The rounding is done on the running time, so every frame starts at most
+	// 1/(2*SnapTimeBase) seconds away from its exact time and the error does not add up.
+	SnapTimeBase uint16
+
+	// PageOffset, if not nil, is written as the oFFs chunk instead of the one
+	// of the first frame. It is the position of the image on a page, not the
+	// offset of a frame on the canvas, which is Offsets.
+	PageOffset *PageOffset
+
+	// Loop is the number of times to play the animation, 0 is infinite looping.
+	Loop int
+
+	// Compatibility selects how the image data is split into chunks.
+	Compatibility Compatibility
+
+	// Dispose and Blend are the dispose_op and blend_op of every frame. If
+	// they are nil all frames use DisposeOpNone and BlendOpSource.
+	Dispose []DisposeOp
+	Blend   []BlendOp
+
+	// Offsets are the x_offset and y_offset of every frame on the canvas. The
+	// canvas has the size of the first frame, the other frames may be smaller
+	// and their region has to fit into the canvas. The first frame is the
+	// default image and cannot have an offset. If Offsets is nil all frames
+	// are at 0, 0 and have to have the size of the first frame.
+	Offsets []image.Point
+
+	// StaticDefault, if true, writes the first frame only as the default image
+	// that viewers without APNG support show. It is not part of the animation,
+	// so its delay, dispose and blend op are not used. A single frame is
+	// written as a PNG without animation either way.
+	StaticDefault bool
+
+	// SkipCRC, if true, does not verify the crc of the chunks of the input
+	// files. That is a bit faster, but the data of a corrupt file is copied
+	// into the output instead of returning a FormatError.
+	SkipCRC bool
+
+	// Progress, if not nil, is called for each frame in order, before the
+	// frame is written, with the index and the name of the frame, e.g. to
+	// print the progress. With Concurrency the frame may already have been
+	// read and converted when it is called.
+	Progress func(frameIndex int, filename string)
+
+	// Transcode, if true, decodes frames with another bit depth or color type
+	// than the first frame with image/png and writes them in the format of
+	// the first frame instead of returning an UnsupportedError. A color type 3
+	// frame gets the closest colors of the palette of the first frame.
+	// Interlaced frames, including the first one, are transcoded as well and
+	// written without interlacing, without Transcode they are an UnsupportedError.
+	Transcode bool
+
+	// Recompress, if true, decompresses the image data of every frame and
+	// compresses it again with CompressionLevel instead of copying it as it
+	// is, for input files that were written with a weak compression.
+	Recompress       bool
+	CompressionLevel png.CompressionLevel
+
+	// ChunkSize is the largest size of the IDAT and fdAT chunks, at least 64
+	// bytes. The image data of the input files is collected into chunks of up
+	// to this size and larger chunks of the input are split. If it is 0 it is
+	// 1 MiB. It is not used with Strict.
+	ChunkSize int
+
+	// Text is written as tEXt chunks, or iTXt chunks if the value is not
+	// ASCII, in the order of the keywords. The tEXt and iTXt chunks of the
+	// first frame are kept unless Text has the same keyword. A value has to
+	// be UTF-8 and cannot contain NUL.
+	Text map[string]string
+
+	// Diff, if true, writes only the region of a frame that changed since
+	// the previous frame, for EncodeImages. The unchanged pixels within the
+	// region are transparent and blended over the previous frame if all the
+	// changed pixels are opaque. A frame without changes is left out and its
+	// delay is added to the previous frame. Dispose and Blend are not used.
+	Diff bool
+
+	// InferDisposal, if true, is Diff that also picks the dispose op of every
+	// frame. The frame is kept, cleared or replaced by what was there before,
+	// whichever leaves the smallest region to write for the next frame.
+	InferDisposal bool
+
+	// PosterImage, if not nil, is written as the default image that viewers
+	// without APNG support show instead of the first frame, for EncodeImages.
+	// It has to have the size of the first frame and is not part of the
+	// animation, like the first frame with StaticDefault, which it cannot be
+	// combined with.
+	PosterImage image.Image
+
+	// OptimizeAlpha, if true, writes the frames of EncodeImages without an
+	// alpha channel and with a tRNS chunk that makes a single color
+	// transparent, which is usually smaller, if every pixel is opaque or fully
+	// transparent. The transparent pixels get that color.
+	OptimizeAlpha bool
+
+	// MergeDuplicates, if true, leaves out a frame whose image data, region,
+	// dispose op and blend op are the same as those of the frame before and
+	// adds its delay to that frame instead. The fcTL and acTL chunks are
+	// corrected afterwards.
+	MergeDuplicates bool
+
+	// Concurrency is the number of frames that are read and converted at
+	// the same time, each of them is held in memory until it is written.
+	// The output is the same as with 0 or 1, which reads the frames one
+	// after another.
+	Concurrency int
+
+	// Context, if not nil, stops the encoding when it is done, like the ctx
+	// of EncodeContext, and its error is returned.
+	Context context.Context
+}
+
+// Compatibility is the chunk arrangement of the output.
+//
+// In both modes acTL directly follows IHDR, each fcTL directly precedes the
+// IDAT or fdAT chunks of its frame and there are no chunks without image data.
+type Compatibility int
+
+const (
+	// Standard merges the source IDAT chunks of a frame into as few chunks
+	// as possible, up to EncodeOptions.ChunkSize each, 1 MiB by default.
+	// Larger source chunks are split.
+	Standard Compatibility = iota
+	// Strict splits the image data of every frame into chunks of exactly
+	// 8192 bytes, plus a shorter last chunk, like libpng does. The chunk
+	// boundaries do not depend on how the source files were chunked and no
+	// chunk is larger than 8192 bytes, for viewers like Safari that are
+	// stricter than the spec.
+	Strict
+)
+
+// strictChunkSize is the image data size of the IDAT and fdAT chunks in Strict mode.
+const strictChunkSize = 8192
+
+// PageOffset is the position of the image on a larger page as stored in an
+// oFFs chunk. X and Y are in the unit given by Unit, 0 for pixels and 1 for
+// micrometers.
+type PageOffset struct {
+	X, Y int32
+	Unit uint8
 }
 
 // Big-endian.
@@ -101,12 +468,18 @@ func writeUint16(b []uint8, u uint16) {
 }
 
 func (e *encoder) writeChunk(b []byte, name string) {
+	e.writeChunkWithPrefix(nil, b, name)
+}
+
+// writeChunkWithPrefix writes a chunk whose data is prefix followed by b,
+// without copying them into one buffer first.
+func (e *encoder) writeChunkWithPrefix(prefix []byte, b []byte, name string) {
 	if e.err != nil {
 		return
 	}
-	n := uint32(len(b))
-	if int(n) != len(b) {
-		e.err = UnsupportedError(name + " chunk is too large: " + strconv.Itoa(len(b)))
+	n := uint32(len(prefix) + len(b))
+	if int(n) != len(prefix)+len(b) {
+		e.err = UnsupportedError(name + " chunk is too large: " + strconv.Itoa(len(prefix)+len(b)))
 		return
 	}
 	writeUint32(e.header[:4], n)
@@ -116,13 +489,23 @@ func (e *encoder) writeChunk(b []byte, name string) {
 	e.header[7] = name[3]
 	crc := crc32.NewIEEE()
 	crc.Write(e.header[4:8])
+	crc.Write(prefix)
 	crc.Write(b)
 	writeUint32(e.footer[:4], crc.Sum32())
+	if e.digest != nil && name == "IDAT" {
+		e.digest.Write(b)
+	}
 
 	_, e.err = e.w.Write(e.header[:8])
 	if e.err != nil {
 		return
 	}
+	if len(prefix) > 0 {
+		_, e.err = e.w.Write(prefix)
+		if e.err != nil {
+			return
+		}
+	}
 	_, e.err = e.w.Write(b)
 	if e.err != nil {
 		return
@@ -141,136 +524,348 @@ func (e *encoder) writeACTL(framenumber, loop int) {
 	e.writeChunk(e.tmp[:8], "acTL")
 }
 
-func (e *encoder) writeFCTL(seqnumber uint32, width int32, height int32, delay int) {
+func gcd(a, b uint64) uint64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// fractionDelays converts delays in units of o.DelayDenominator, or o.TimeBase
+// if it is set, to the fractions written into fcTL. Delays that do not fit
+// into 16 bits are reduced if possible, otherwise they are rounded to the
+// closest fraction like durations are, and a delay that cannot be written at
+// all is an error.
+func fractionDelays(delays []int, o *EncodeOptions) ([]Delay, error) {
+	var delayDen, snap uint16
+	var timeBase Rational
+	if o != nil {
+		delayDen = o.DelayDenominator
+		timeBase = o.TimeBase
+		snap = o.SnapTimeBase
+	}
+
+	fractions := make([]Delay, len(delays))
+	var elapsed uint64 // sum of the delays so far, in units of timeBase
+	for i, delay := range delays {
+		if delay < 0 {
+			return nil, FormatError(fmt.Sprintf("negative delay %d of frame %d", delay, i))
+		}
+		var num, den uint64
+		if timeBase.Den == 0 {
+			if delay <= 0xffff {
+				fractions[i] = Delay{uint16(delay), delayDen}
+				continue
+			}
+			num, den = uint64(delay), uint64(delayDen)
+			if den == 0 {
+				den = 100
+			}
+		} else {
+			num, den = uint64(delay)*uint64(timeBase.Num), uint64(timeBase.Den)
+		}
+		if timeBase.Den != 0 && snap != 0 {
+			// Round the start and end time of the frame to the nearest 1/snap seconds
+			round := func(units uint64) uint64 {
+				return (2*units*uint64(timeBase.Num)*uint64(snap) + den) / (2 * den)
+			}
+			num = round(elapsed+uint64(delay)) - round(elapsed)
+			den = uint64(snap)
+			if num > 0xffff {
+				return nil, UnsupportedError(fmt.Sprintf("delay %d of frame %d, %d/%d seconds, does not fit into fcTL", delay, i, num, den))
+			}
+			fractions[i] = Delay{uint16(num), uint16(den)}
+		} else {
+			fractions[i] = fitDelay(num, den)
+			if fractions[i].Den == 0 {
+				return nil, UnsupportedError(fmt.Sprintf("delay %d of frame %d, %d/%d seconds, does not fit into fcTL", delay, i, num, den))
+			}
+		}
+		elapsed += uint64(delay)
+	}
+	return fractions, nil
+}
+
+// fitDelay returns the fraction num/den seconds as a fcTL delay, reduced if
+// possible. If it does not fit into 16 bits it is rounded to the closest
+// fraction that fits, the last convergent of its continued fraction, e.g.
+// 1/30 for 33333333/1000000000. The Den of the result is 0 if there is none,
+// e.g. for more than 65535 seconds, or if a delay that is not 0 would become 0.
+// DurationDelays and fractionDelays both use it, so a delay gets the same
+// fraction whichever way it is given.
+func fitDelay(num, den uint64) Delay {
+	g := gcd(num, den)
+	num, den = num/g, den/g
+	if num <= 0xffff && den <= 0xffff {
+		return Delay{uint16(num), uint16(den)}
+	}
+	var p0, q0, p1, q1 uint64 = 0, 1, 1, 0
+	for den != 0 {
+		a := num / den
+		if a > 0xffff {
+			break
+		}
+		p2, q2 := a*p1+p0, a*q1+q0
+		if p2 > 0xffff || q2 > 0xffff {
+			break
+		}
+		p0, q0, p1, q1 = p1, q1, p2, q2
+		num, den = den, num-a*den
+	}
+	if p1 == 0 {
+		return Delay{}
+	}
+	return Delay{uint16(p1), uint16(q1)}
+}
+
+func (e *encoder) writeFCTL(seqnumber uint32, fc frameControl) {
 	// https://wiki.mozilla.org/APNG_Specification#.60fcTL.60:_The_Frame_Control_Chunk
-	writeUint32(e.tmp[0:4], seqnumber)       // Sequence number of the animation chunk, starting from 0. Animation chunks are both fcTL and fdAT
-	writeUint32(e.tmp[4:8], uint32(width))   // Width of the following frame
-	writeUint32(e.tmp[8:12], uint32(height)) // Height of the following frame
-	writeUint32(e.tmp[12:16], uint32(0))     // X position at which to render the following frame
-	writeUint32(e.tmp[16:20], uint32(0))     // Y position at which to render the following frame
-	writeUint16(e.tmp[20:22], uint16(delay)) // Frame delay fraction numerator
+	writeUint32(e.tmp[0:4], seqnumber)            // Sequence number of the animation chunk, starting from 0. Animation chunks are both fcTL and fdAT
+	writeUint32(e.tmp[4:8], uint32(fc.width))     // Width of the following frame
+	writeUint32(e.tmp[8:12], uint32(fc.height))   // Height of the following frame
+	writeUint32(e.tmp[12:16], uint32(fc.xOffset)) // X position at which to render the following frame
+	writeUint32(e.tmp[16:20], uint32(fc.yOffset)) // Y position at which to render the following frame
+	writeUint16(e.tmp[20:22], fc.delayNum)        // Frame delay fraction numerator
 	// If the denominator is 0, it is to be treated as if it were 100 (that is, `delay_num` then specifies 1/100ths of a second)
-	writeUint16(e.tmp[22:24], uint16(0)) // Frame delay fraction denominator
-	e.tmp[24] = 0                        // Type of frame area disposal to be done after rendering this frame
-	e.tmp[25] = 0                        // Type of frame area rendering for this frame
+	writeUint16(e.tmp[22:24], fc.delayDen) // Frame delay fraction denominator
+	e.tmp[24] = uint8(fc.disposeOp)        // Type of frame area disposal to be done after rendering this frame
+	e.tmp[25] = uint8(fc.blendOp)          // Type of frame area rendering for this frame
+	if e.dedup && e.err == nil {
+		// Remember the fcTL to add the delays of duplicates of its frame
+		e.lastFCTL, e.err = e.seeker.Seek(0, io.SeekCurrent)
+		e.lastFC, e.lastSeq = &fc, seqnumber
+	}
 	e.writeChunk(e.tmp[:26], "fcTL")
+	e.frames++
 	//fmt.Printf("seqnumber: %d",seqnumber)
 }
 
-func (e *encoder) copyIDAT(filename string, width int32, height int32, delay int) {
-	e.animationChunks = 0
-
-	// Copy all IDAT chunks of the first png file into the "encoder file"
-	r, err := os.Open(filename)
-	if err != nil {
-		log.Fatalf("Could not open frame file: %s", filename)
+// writePendingFCTL writes the fcTL of the frame whose first fdAT chunk is
+// about to be written. A frame without image data gets no fcTL at all.
+func (e *encoder) writePendingFCTL() {
+	if e.pending != nil {
+		e.writeFCTL(e.animationChunks, *e.pending)
+		e.animationChunks++
+		e.pending = nil
 	}
-	defer r.Close()
+}
 
-	d := &decoder{
-		r:   r,
-		crc: crc32.NewIEEE(),
+// rewriteACTL corrects the number of frames in the acTL chunk, which was
+// already written, to the number of fcTL chunks that were written.
+func (e *encoder) rewriteACTL(loop int) {
+	if e.err != nil {
+		return
 	}
-
-	// check header
-	if err := d.checkHeader(); err != nil {
-		log.Fatalf("No PNG header found in %s", filename)
+	if e.frames == 0 {
+		e.err = FormatError("none of the frames has image data")
+		return
+	}
+	if e.seeker == nil {
+		e.err = FormatError(fmt.Sprintf("only %d frames have image data and acTL cannot be corrected because the writer is not an io.WriteSeeker", e.frames))
+		return
+	}
+	var end int64
+	end, e.err = e.seeker.Seek(0, io.SeekCurrent)
+	if e.err == nil {
+		_, e.err = e.seeker.Seek(e.actl, io.SeekStart)
 	}
+	e.writeACTL(e.frames, loop)
+	if e.err == nil {
+		_, e.err = e.seeker.Seek(end, io.SeekStart)
+	}
+}
 
-	// Skip over IHDR
-	var length uint32
-	length, err = d.parseChunk()
-	if err != nil {
-		log.Fatalf("Could not read IHDR of %s", filename)
+// canceled reports whether e.ctx is done and sets e.err to its error then.
+func (e *encoder) canceled() bool {
+	if e.ctx == nil || e.err != nil {
+		return false
 	}
+	e.err = e.ctx.Err()
+	return e.err != nil
+}
 
-	// Write frame
-	e.writeFCTL(e.animationChunks, width, height, delay)
-	e.animationChunks++
+// maxChunkSize returns the size up to which the IDAT and fdAT chunks are filled.
+func (e *encoder) maxChunkSize() int {
+	if e.chunkSize != 0 {
+		return e.chunkSize
+	}
+	return maxChunkSize
+}
 
-	// Read all IDAT chunks and convert them into bigger IDAT chunks
-	maxfdATlength := uint32(maxChunkSize - 5*4)
-	var buffer []byte = make([]byte, maxfdATlength)
-	buffer = buffer[:0]
-	for {
-		length, err = d.parseChunk()
-		if d.ChunkName == "IDAT" {
-			if uint32(len(buffer))+length > maxfdATlength {
-				// Write new IDAT chunk
-				e.writeChunk(buffer, "IDAT")
-				//fmt.Printf("seqnumber: %d\n",e.animationChunks)
+// truncater is a file like *os.File that chunks can be removed from.
+type truncater interface {
+	io.ReaderAt
+	io.WriteSeeker
+	Truncate(size int64) error
+}
 
-				// Clear buffer
-				buffer = buffer[:0]
-			}
+// canSeek reports whether s can report its position, e.g. an *os.File of a
+// pipe cannot.
+func canSeek(s io.Seeker) bool {
+	_, err := s.Seek(0, io.SeekCurrent)
+	return err == nil
+}
 
-			// Write the current IDAT stripping the leading length and chunk identifier and the trailing CRC checksum
-			buffer = append(buffer, d.tmp[8:length-4]...)
+// memFile is a truncater in memory, for the output of encode if the writer
+// cannot seek.
+type memFile struct {
+	b   []byte
+	pos int64
+}
 
+func (m *memFile) Write(p []byte) (int, error) {
+	if m.pos == int64(len(m.b)) {
+		m.b = append(m.b, p...)
+	} else {
+		if end := m.pos + int64(len(p)); end > int64(len(m.b)) {
+			m.b = append(m.b, make([]byte, end-int64(len(m.b)))...)
 		}
-		if d.ChunkName == "IEND" {
-			break
-		}
+		copy(m.b[m.pos:], p)
 	}
-	// Write last chunk
-	if len(buffer) > 4 {
-		e.writeChunk(buffer[:], "IDAT")
+	m.pos += int64(len(p))
+	return len(p), nil
+}
+
+func (m *memFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += m.pos
+	case io.SeekEnd:
+		offset += int64(len(m.b))
+	}
+	if offset < 0 {
+		return 0, errors.New("png: negative position")
 	}
+	m.pos = offset
+	return offset, nil
+}
 
+func (m *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(m.b)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
 }
 
-func (e *encoder) writeFDAT(filename string, width int32, height int32, delay int) {
-	//https://wiki.mozilla.org/APNG_Specification#.60fdAT.60:_The_Frame_Data_Chunk
+func (m *memFile) Truncate(size int64) error {
+	if size < int64(len(m.b)) {
+		m.b = m.b[:size]
+	} else {
+		m.b = append(m.b, make([]byte, size-int64(len(m.b)))...)
+	}
+	return nil
+}
 
-	r, err := os.Open(filename)
+// removeAnimation removes the acTL chunk at e.actl and the fcTL chunk of the
+// first frame at fctl from f, which is written up to its current position,
+// when the first frame is the only one.
+func (e *encoder) removeAnimation(f truncater, fctl int64) {
+	end, err := f.Seek(0, io.SeekCurrent)
 	if err != nil {
-		log.Fatalf("Could not open frame file: %s", filename)
+		e.err = err
+		return
 	}
-	defer r.Close()
-
-	d := &decoder{
-		r:   r,
-		crc: crc32.NewIEEE(),
+	// Move the chunks between acTL and fcTL and the chunks after fcTL to the front
+	const actlLength, fctlLength = 8 + 12, 26 + 12
+	dst := e.actl
+	for _, part := range [][2]int64{{e.actl + actlLength, fctl}, {fctl + fctlLength, end}} {
+		if _, err := f.Seek(dst, io.SeekStart); err != nil {
+			e.err = err
+			return
+		}
+		// The writer is wrapped so that the part is copied with ReadAt and Write in order
+		n, err := io.Copy(struct{ io.Writer }{f}, io.NewSectionReader(f, part[0], part[1]-part[0]))
+		if err != nil {
+			e.err = err
+			return
+		}
+		dst += n
 	}
-
-	// check header
-	if err := d.checkHeader(); err != nil {
-		log.Fatalf("No PNG header found in %s", filename)
+	if e.err = f.Truncate(dst); e.err == nil {
+		_, e.err = f.Seek(dst, io.SeekStart)
 	}
+}
+
+// copyIDAT writes the first frame as the default image. d must be positioned
+// after the IHDR and the ancillary chunks, right before the first IDAT.
+// If animated is false the default image gets no fcTL and is not part of the animation.
+func (e *encoder) copyIDAT(d *decoder, name string, fc frameControl, animated bool) {
+	e.animationChunks = 0
 
-	// Skip over IHDR
 	var length uint32
-	length, err = d.parseChunk()
-	if err != nil {
-		log.Fatalf("Could not read IHDR of %s", filename)
-	}
+	var err error
 
 	// Write frame
-	//e.writeFCTL(seqnumber,width,height,delay)
-	e.writeFCTL(e.animationChunks, width, height, delay)
-	e.animationChunks++
+	if animated {
+		e.writeFCTL(e.animationChunks, fc)
+		e.animationChunks++
+	}
 
-	// Read all IDAT chunks and convert them into fdAT chunks
-	var fourbytes []byte = make([]byte, 4)
-	maxfdATlength := uint32(maxChunkSize - 5*4) //    minus:  4byteoffset,length,"fdAT",seqnumber,crc
-	var buffer []byte = make([]byte, maxfdATlength)
-	buffer = buffer[:0]
+	// Read all IDAT chunks and convert them into bigger IDAT chunks.
+	// The buffer grows up to maxfdATlength, larger IDAT chunks are split
+	maxfdATlength := uint32(e.maxChunkSize() - 5*4)
+	limit := int(maxfdATlength) - 12 // image data of a full IDAT chunk
+	if e.compatibility == Strict {
+		limit = strictChunkSize
+	}
+	var buffer []byte
+	idat := 0 // number of IDAT chunks read
+	for e.err == nil && !e.canceled() {
+		length, err = d.readChunkHeader()
+		if err != nil {
+			e.err = inputError(name, err)
+			return
+		}
+		if d.ChunkName != "IDAT" {
+			if err = d.skipChunkBody(length); err != nil {
+				e.err = inputError(name, err)
+				return
+			}
+		} else {
+			idat++
+			if e.compatibility == Strict || length > maxfdATlength {
+				// Fill every IDAT chunk up to limit, splitting the source chunk where needed
+				for left := int(length - 12); left > 0 && err == nil; {
+					n := min(limit-len(buffer), left)
+					buffer, err = d.appendChunkData(buffer, n)
+					left -= n
+					if len(buffer) == limit {
+						e.writeChunk(buffer, "IDAT")
+						buffer = buffer[:0]
+					}
+				}
+				if err == nil {
+					err = d.readCRC()
+				}
+				if err != nil {
+					e.err = inputError(name, err)
+					return
+				}
+				continue
+			}
+
+			if err = d.readChunkBody(length); err != nil {
+				e.err = inputError(name, err)
+				return
+			}
+
+			if len(buffer) == 0 && d.lastInRun(0, length, maxfdATlength) {
+				// This IDAT becomes a chunk of its own, write it directly without copying it into the buffer
+				e.writeChunk(d.tmp[8:length-4], "IDAT")
+				continue
+			}
 
-	writeUint32(fourbytes, e.animationChunks) // Write with the sequence number at the beginning
-	buffer = append(buffer, fourbytes...)
-	e.animationChunks++
-	for {
-		length, err = d.parseChunk()
-		if d.ChunkName == "IDAT" {
 			if uint32(len(buffer))+length > maxfdATlength {
-				// Write fdAT chunk
-				e.writeChunk(buffer, "fdAT")
+				// Write new IDAT chunk
+				e.writeChunk(buffer, "IDAT")
+				//fmt.Printf("seqnumber: %d\n",e.animationChunks)
 
 				// Clear buffer
 				buffer = buffer[:0]
-				writeUint32(fourbytes, e.animationChunks) // Write with the sequence number at the beginning
-				buffer = append(buffer, fourbytes...)
-				e.animationChunks++
 			}
 
 			// Write the current IDAT stripping the leading length and chunk identifier and the trailing CRC checksum
@@ -282,176 +877,2530 @@ func (e *encoder) writeFDAT(filename string, width int32, height int32, delay in
 		}
 	}
 	// Write last chunk
-	if len(buffer) > 4 {
-		e.writeChunk(buffer[:], "fdAT")
-		//fmt.Printf("seqnumber: %d\n",e.animationChunks)
-	} else {
-		// last chunk contains no data, only the sequence number, so we discard the last chunk
-		e.animationChunks--
+	if len(buffer) > 0 {
+		e.writeChunk(buffer[:], "IDAT")
+	}
+	if idat == 0 && e.err == nil {
+		e.err = FormatError(name + ": no IDAT chunk")
 	}
 }
 
-// Encode writes all the png files in frames into the output file w.
-// All the png files must be encoded in the same manner and must have the same dimensions.
-// (Meaning each file should have the same IHDR chunk because only the first IHDR is evaluated)
-func Encode(w io.Writer, pngfiles []string, delays []int) {
-	e := &encoder{
-		w: w,
+// transcodeFDAT decodes the frame d, whose IHDR was just read, with image/png
+// and writes it with the bit depth and color type of the first frame.
+func (e *encoder) transcodeFDAT(d *decoder, name string, fc frameControl) {
+	r := io.MultiReader(bytes.NewReader([]byte(pngHeader)), bytes.NewReader(d.tmp), d.r)
+	img, err := png.Decode(r)
+	if err != nil {
+		e.err = fmt.Errorf("could not decode %s: %v", name, err)
+		return
+	}
+	var b bytes.Buffer
+	if err := writeConverted(&b, img, e.bitDepth, e.colorType, e.palette()); err != nil {
+		e.err = fmt.Errorf("could not transcode %s: %v", name, err)
+		return
 	}
+	e.writeFDAT(&b, name, fc)
+}
 
-	// Open first frame
-	r, err := os.Open(pngfiles[0])
+// deinterlace decodes the interlaced first frame d with image/png and returns
+// a decoder of the frame encoded without interlacing, positioned before the
+// first IDAT like d. ihdr is the IHDR chunk of the frame, d is positioned
+// after the ancillary chunks.
+func (e *encoder) deinterlace(d *decoder, name string, ihdr []byte) (*decoder, error) {
+	var head bytes.Buffer
+	h := &encoder{
+		w: &head,
+	}
+	head.WriteString(pngHeader)
+	head.Write(ihdr)
+	if e.plte != nil {
+		h.writeChunk(e.plte, "PLTE")
+	}
+	if e.trns != nil {
+		h.writeChunk(e.trns, "tRNS")
+	}
+	img, err := png.Decode(io.MultiReader(&head, d.r))
 	if err != nil {
-		log.Fatalf("Could not open first frame file: %s", pngfiles[0])
+		return nil, fmt.Errorf("could not decode %s: %v", name, err)
+	}
+	var b bytes.Buffer
+	if err := writeConverted(&b, img, e.bitDepth, e.colorType, e.palette()); err != nil {
+		return nil, fmt.Errorf("could not transcode %s: %v", name, err)
 	}
-	defer r.Close()
 
-	d := &decoder{
-		r:   r,
+	d = &decoder{
+		r:   bufio.NewReader(&b),
 		crc: crc32.NewIEEE(),
 	}
-
-	var length uint32 // chunk length
-
-	// check header of first frame
 	if err := d.checkHeader(); err != nil {
-		log.Fatalf("No PNG header found!")
+		return nil, err
 	}
-
-	// Write png header to output
-	e.w.Write(d.tmp[0:8])
-
-	// Copy IHDR from first frame to output
-	length, err = d.parseChunk()
-	if err != nil {
-		log.Fatalf("Could not read IHDR from first file.")
+	if _, err := d.parseChunk(); err != nil {
+		return nil, err
 	}
-	e.w.Write(d.tmp[0:length])
-	width := int32(binary.BigEndian.Uint32(d.tmp[8:12]))
-	height := int32(binary.BigEndian.Uint32(d.tmp[12:16]))
-
-	fmt.Printf("Image dimensions: %d x %d\n", width, height)
-
-	fmt.Printf("Encoding: %s\n", pngfiles[0])
-
-	// Write ACTL chunk
-	e.writeACTL(len(pngfiles), 0)
-
-	// Write first image
-	e.copyIDAT(pngfiles[0], width, height, delays[0])
+	return d, nil
+}
 
-	// Read/Write the other files
-	for i := 1; i < len(pngfiles); i++ {
-		fmt.Printf("Encoding: %s\n", pngfiles[i])
-		e.writeFDAT(pngfiles[i], width, height, delays[i])
+// zlibLevel returns the zlib compression level of a png.CompressionLevel, like image/png does.
+func zlibLevel(l png.CompressionLevel) int {
+	switch l {
+	case png.NoCompression:
+		return zlib.NoCompression
+	case png.BestSpeed:
+		return zlib.BestSpeed
+	case png.BestCompression:
+		return zlib.BestCompression
 	}
+	return zlib.DefaultCompression
+}
 
-	// Write End chunk
-	e.writeIEND()
-
-	fmt.Printf("Wrote %d frames split up in %d animation chunks\n", len(pngfiles), e.animationChunks)
+// idatReader reads the image data of all IDAT chunks of a decoder up to IEND.
+type idatReader struct {
+	d    *decoder
+	left int // data bytes left in the current IDAT chunk
+	done bool
 }
 
-// Readln returns a single line (without the ending \n)
-// from the input buffered reader.
-// An error is returned iff there is an error with the
-// buffered reader.
-func Readln(r *bufio.Reader) (string, error) {
-	var (
-		isPrefix bool  = true
-		err      error = nil
-		line, ln []byte
-	)
-	for isPrefix && err == nil {
-		line, isPrefix, err = r.ReadLine()
-		ln = append(ln, line...)
+func (r *idatReader) Read(p []byte) (int, error) {
+	d := r.d
+	for r.left == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		length, err := d.readChunkHeader()
+		if err != nil {
+			return 0, err
+		}
+		switch d.ChunkName {
+		case "IDAT":
+			r.left = int(length - 12)
+			if r.left == 0 {
+				err = d.readCRC()
+			}
+		case "IEND":
+			r.done = true
+			fallthrough
+		default:
+			err = d.skipChunkBody(length)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := d.r.Read(p[:min(len(p), r.left)])
+	if !d.skipCRC {
+		d.crc.Write(p[:n])
 	}
-	return string(ln), err
+	r.left -= n
+	if r.left == 0 && err == nil {
+		err = d.readCRC()
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
 }
 
-// Command line arguments
-var dirname string
+// recompressed decompresses the image data of the IDAT chunks of d and
+// returns a decoder of it compressed again with the compression level of e,
+// positioned before the IDAT chunk. d has to be positioned before the first IDAT.
+func (e *encoder) recompressed(d *decoder) (*decoder, error) {
+	zr, err := zlib.NewReader(&idatReader{d: d})
+	if err != nil {
+		return nil, err
+	}
+	var data bytes.Buffer
+	zw, err := zlib.NewWriterLevel(&data, e.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(zw, zr); err != nil {
+		return nil, err
+	}
+	if err := zr.Close(); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
 
-func init() {
-	const (
-		defaultDirname = "frames"
-		usage          = "The folder containing the source PNG files"
-	)
-	flag.StringVar(&dirname, "input", defaultDirname, usage)
-	flag.StringVar(&dirname, "i", defaultDirname, usage+"-input (shorthand)")
+	var b bytes.Buffer
+	h := &encoder{
+		w: &b,
+	}
+	h.writeChunk(data.Bytes(), "IDAT")
+	h.writeIEND()
+	return &decoder{
+		r:   bufio.NewReader(&b),
+		crc: crc32.NewIEEE(),
+	}, h.err
 }
 
-var delayfile string
+// palette returns the colors of the PLTE and tRNS chunks of the first frame.
+func (e *encoder) palette() color.Palette {
+	pal := make(color.Palette, len(e.plte)/3)
+	for i := range pal {
+		c := color.NRGBA{e.plte[3*i], e.plte[3*i+1], e.plte[3*i+2], 0xff}
+		if i < len(e.trns) {
+			c.A = e.trns[i]
+		}
+		pal[i] = c
+	}
+	return pal
+}
 
-func init() {
-	const (
-		defaultDelayfile = "delays.txt"
-		usage            = "A text file containing the duration of each frame in milliseconds. Split by line."
-	)
-	flag.StringVar(&delayfile, "delays", defaultDelayfile, usage)
-	flag.StringVar(&delayfile, "d", defaultDelayfile, "-delays (shorthand)")
+// inputError adds the name of the input file to an error of reading its chunks.
+func inputError(name string, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return FormatError(name + ": unexpected EOF before IEND")
+	}
+	if f, ok := err.(FormatError); ok {
+		return FormatError(name + ": " + string(f))
+	}
+	return fmt.Errorf("%s: %v", name, err)
 }
 
-var output string
+// validKeyword reports whether key can be the keyword of a tEXt or iTXt
+// chunk: 1 to 79 printable Latin-1 characters without leading, trailing or
+// consecutive spaces.
+func validKeyword(key string) bool {
+	if len(key) < 1 || len(key) > 79 || key[0] == ' ' || key[len(key)-1] == ' ' || strings.Contains(key, "  ") {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 32 || key[i] > 126 {
+			return false
+		}
+	}
+	return true
+}
 
-func init() {
-	const (
-		defaultOutput = "output.png"
-		usage         = "The destination file."
-	)
-	flag.StringVar(&output, "output", defaultOutput, usage)
-	flag.StringVar(&output, "o", defaultOutput, "-output (shorthand)")
+// validText reports whether value can be the text of a tEXt or iTXt chunk:
+// no NUL, which separates the fields, and UTF-8 because iTXt is UTF-8.
+func validText(value string) bool {
+	return strings.IndexByte(value, 0) < 0 && utf8.ValidString(value)
 }
 
-func main() {
+// textKeyword returns the keyword of the tEXt or iTXt chunk data.
+func textKeyword(data []byte) string {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return string(data[:i])
+	}
+	return string(data)
+}
+
+// writeText writes text as tEXt and iTXt chunks sorted by keyword.
+func (e *encoder) writeText(text map[string]string) {
+	keys := make([]string, 0, len(text))
+	for key := range text {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := text[key]
+		ascii := true
+		for i := 0; i < len(value); i++ {
+			if value[i] >= 0x80 {
+				ascii = false
+				break
+			}
+		}
+		data := append([]byte(key), 0)
+		if ascii {
+			e.writeChunk(append(data, value...), "tEXt")
+			continue
+		}
+		// Not compressed, no language tag and no translated keyword
+		data = append(data, 0, 0, 0, 0)
+		e.writeChunk(append(data, value...), "iTXt")
+	}
+}
+
+// writeFDATChunk writes data as an fdAT chunk with the next sequence number.
+func (e *encoder) writeFDATChunk(data []byte) {
+	if e.prepared != nil {
+		if e.pending != nil {
+			e.prepared.fc = e.pending
+			e.pending = nil
+		}
+		e.prepared.chunks = append(e.prepared.chunks, append([]byte(nil), data...))
+		return
+	}
+	e.writePendingFCTL()
+	writeUint32(e.seq[:], e.animationChunks)
+	e.writeChunkWithPrefix(e.seq[:], data, "fdAT")
+	e.animationChunks++
+}
+
+func (e *encoder) writeFDAT(r io.Reader, name string, fc frameControl) {
+	//https://wiki.mozilla.org/APNG_Specification#.60fdAT.60:_The_Frame_Data_Chunk
+
+	d := &decoder{
+		r:       bufio.NewReader(r),
+		crc:     crc32.NewIEEE(),
+		skipCRC: e.skipCRC,
+	}
+
+	// check header
+	if err := d.checkHeader(); err != nil {
+		e.err = fmt.Errorf("no PNG header found in %s: %v", name, err)
+		return
+	}
+
+	// Skip over IHDR
+	length, err := d.parseChunk()
+	if err != nil || d.ChunkName != "IHDR" || length != 13+12 {
+		e.err = FormatError("could not read IHDR of " + name)
+		return
+	}
+
+	// The pixel format of every frame has to be the one of the first frame, the
+	// image data is copied as it is and interpreted with the first IHDR
+	// An interlaced frame is transcoded as well, the output is not interlaced
+	if d.tmp[16] != e.bitDepth || d.tmp[17] != e.colorType || d.tmp[20] != 0 {
+		if e.transcode {
+			e.transcodeFDAT(d, name, fc)
+			return
+		}
+		if d.tmp[20] != 0 {
+			e.err = UnsupportedError(name + " is interlaced")
+			return
+		}
+		e.err = UnsupportedError(fmt.Sprintf("%s has bit depth %d and color type %d but the first frame has bit depth %d and color type %d", name, d.tmp[16], d.tmp[17], e.bitDepth, e.colorType))
+		return
+	}
+
+	// Without sub-frames every frame has the size of the canvas, otherwise
+	// the frame region has to fit into the canvas
+	fc.width = int(binary.BigEndian.Uint32(d.tmp[8:12]))
+	fc.height = int(binary.BigEndian.Uint32(d.tmp[12:16]))
+	if !e.subFrames && (fc.width != e.width || fc.height != e.height) {
+		e.err = FormatError(fmt.Sprintf("%s is %d x %d but the first frame is %d x %d", name, fc.width, fc.height, e.width, e.height))
+		return
+	}
+	if fc.width > e.width-fc.xOffset || fc.height > e.height-fc.yOffset {
+		e.err = FormatError(fmt.Sprintf("%s is %d x %d at %d, %d which does not fit into the canvas of %d x %d", name, fc.width, fc.height, fc.xOffset, fc.yOffset, e.width, e.height))
+		return
+	}
+
+	if e.recompress {
+		d, err = e.recompressed(d)
+		if err != nil {
+			e.err = inputError(name, err)
+			return
+		}
+	}
+
+	// Write frame, the fcTL is written in front of the first fdAT
+	//e.writeFCTL(seqnumber,width,height,delay)
+	e.pending = &fc
+	defer func() {
+		// frame without image data
+		e.pending = nil
+	}()
+
+	// Read all IDAT chunks and convert them into fdAT chunks.
+	// The buffer only holds image data, the sequence number is put in front
+	// of it when the fdAT chunk is written.
+	// The buffer grows up to maxfdATlength, larger IDAT chunks are split
+	maxfdATlength := uint32(e.maxChunkSize() - 5*4) //    minus:  4byteoffset,length,"fdAT",seqnumber,crc
+	limit := int(maxfdATlength) - 16                //    image data of a full fdAT chunk
+	if e.compatibility == Strict {
+		limit = strictChunkSize
+	}
+	var buffer []byte
+
+	for e.err == nil && !e.canceled() {
+		length, err = d.readChunkHeader()
+		if err != nil {
+			e.err = inputError(name, err)
+			return
+		}
+		if d.ChunkName != "IDAT" {
+			if err = d.skipChunkBody(length); err != nil {
+				e.err = inputError(name, err)
+				return
+			}
+		} else {
+			if e.compatibility == Strict || length > maxfdATlength-4 {
+				// Fill every fdAT chunk up to limit, splitting the source chunk where needed
+				for left := int(length - 12); left > 0 && err == nil; {
+					n := min(limit-len(buffer), left)
+					buffer, err = d.appendChunkData(buffer, n)
+					left -= n
+					if len(buffer) == limit {
+						e.writeFDATChunk(buffer)
+						buffer = buffer[:0]
+					}
+				}
+				if err == nil {
+					err = d.readCRC()
+				}
+				if err != nil {
+					e.err = inputError(name, err)
+					return
+				}
+				continue
+			}
+
+			if err = d.readChunkBody(length); err != nil {
+				e.err = inputError(name, err)
+				return
+			}
+
+			if len(buffer) == 0 && d.lastInRun(4, length, maxfdATlength) {
+				// This IDAT becomes an fdAT chunk of its own, write it directly behind the sequence number without copying it into the buffer
+				e.writeFDATChunk(d.tmp[8 : length-4])
+				continue
+			}
+
+			if 4+uint32(len(buffer))+length > maxfdATlength {
+				// Write fdAT chunk
+				e.writeFDATChunk(buffer)
+
+				// Clear buffer
+				buffer = buffer[:0]
+			}
+
+			// Write the current IDAT stripping the leading length and chunk identifier and the trailing CRC checksum
+			buffer = append(buffer, d.tmp[8:length-4]...)
+
+		}
+		if d.ChunkName == "IEND" {
+			break
+		}
+	}
+	// Write last chunk, there is none if all image data was already written
+	if len(buffer) > 0 {
+		e.writeFDATChunk(buffer)
+	}
+}
+
+// prepareFrame reads a frame in the way writeFDAT writes it, but into memory.
+// e is not modified, so frames can be prepared at the same time.
+func (e *encoder) prepareFrame(name string, open func() (io.ReadCloser, error), fc frameControl) *preparedFrame {
+	p := &preparedFrame{}
+	r, err := open()
+	if err != nil {
+		p.err = fmt.Errorf("could not open frame %s: %v", name, err)
+		return p
+	}
+	defer r.Close()
+	w := *e
+	w.err = nil
+	w.pending = nil
+	w.prepared = p
+	w.writeFDAT(r, name, fc)
+	p.err = w.err
+	if e.dedup && p.fc != nil {
+		digest := sha256.New()
+		for _, data := range p.chunks {
+			digest.Write(data)
+		}
+		p.digest = frameDigest(digest, p.fc)
+	}
+	return p
+}
+
+// frameDigest returns the digest of the image data digest and of the region,
+// dispose op and blend op of fc.
+func frameDigest(digest hash.Hash, fc *frameControl) []byte {
+	var b [18]byte
+	writeUint32(b[0:4], uint32(fc.width))
+	writeUint32(b[4:8], uint32(fc.height))
+	writeUint32(b[8:12], uint32(fc.xOffset))
+	writeUint32(b[12:16], uint32(fc.yOffset))
+	b[16] = uint8(fc.disposeOp)
+	b[17] = uint8(fc.blendOp)
+	digest.Write(b[:])
+	return digest.Sum(nil)
+}
+
+// mergeFrame adds the delay of fc to the fcTL of the last frame that was
+// written, if the sum of both delays fits into fcTL.
+func (e *encoder) mergeFrame(fc *frameControl) bool {
+	den1, den2 := uint64(e.lastFC.delayDen), uint64(fc.delayDen)
+	if den1 == 0 {
+		den1 = 100
+	}
+	if den2 == 0 {
+		den2 = 100
+	}
+	num, den := uint64(e.lastFC.delayNum)*den2+uint64(fc.delayNum)*den1, den1*den2
+	g := gcd(num, den)
+	num, den = num/g, den/g
+	if num > 0xffff || den > 0xffff {
+		return false
+	}
+	merged := *e.lastFC
+	merged.delayNum, merged.delayDen = uint16(num), uint16(den)
+
+	var end int64
+	end, e.err = e.seeker.Seek(0, io.SeekCurrent)
+	if e.err == nil {
+		_, e.err = e.seeker.Seek(e.lastFCTL, io.SeekStart)
+	}
+	// The frame was already counted
+	frames := e.frames
+	e.writeFCTL(e.lastSeq, merged)
+	e.frames = frames
+	if e.err == nil {
+		_, e.err = e.seeker.Seek(end, io.SeekStart)
+	}
+	return true
+}
+
+// writePrepared writes the frame p with the next sequence numbers.
+// With dedup a frame with the same image data as the frame before is
+// merged into it instead.
+func (e *encoder) writePrepared(p *preparedFrame) {
+	if p.fc == nil {
+		// frame without image data
+		return
+	}
+	if e.dedup {
+		if e.lastFC != nil && bytes.Equal(p.digest, e.last) && e.mergeFrame(p.fc) {
+			return
+		}
+		e.last = p.digest
+	}
+	e.pending = p.fc
+	for _, data := range p.chunks {
+		e.writeFDATChunk(data)
+	}
+	e.pending = nil
+}
+
+// writeFramesConcurrently writes the frames after the first one, up to n
+// of them are prepared at the same time and they are written in order.
+func (e *encoder) writeFramesConcurrently(n int, names []string, open func(i int) (io.ReadCloser, error), frame func(i int) frameControl, progress func(frameIndex int, filename string)) {
+	results := make([]chan *preparedFrame, len(names))
+	for i := range results {
+		results[i] = make(chan *preparedFrame, 1)
+	}
+	// The frames are prepared with a copy of e that is not written to
+	base := *e
+	// sem limits the frames that are prepared or wait to be written
+	sem := make(chan struct{}, n)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	// Stop preparing frames and wait for the frames that are read at the
+	// moment, nothing is read after encode returned
+	defer wg.Wait()
+	defer close(done)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i < len(names); i++ {
+			select {
+			case sem <- struct{}{}:
+			case <-done:
+				return
+			}
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i] <- base.prepareFrame(names[i], func() (io.ReadCloser, error) { return open(i) }, frame(i))
+			}(i)
+		}
+	}()
+
+	for i := 1; i < len(names) && e.err == nil && !e.canceled(); i++ {
+		p := <-results[i]
+		<-sem
+		if progress != nil {
+			progress(i, names[i])
+		}
+		if p.err != nil {
+			e.err = p.err
+			return
+		}
+		e.writePrepared(p)
+	}
+}
+
+// Encode writes all the png files in frames into the output file w.
+// All the png files must be encoded in the same manner.
+// (Meaning each file should have the same IHDR chunk apart from the dimensions because only the first IHDR is evaluated)
+// A frame with another bit depth or color type than the first one is an UnsupportedError.
+// The first file is the canvas, a frame of another size is a FormatError. With EncodeOptions.Offsets
+// a frame may be smaller, a frame that does not fit into the canvas at its offset is a FormatError.
+// The delays are in 1/100ths of a second.
+// An animation needs at least one frame, an empty pngfiles is a FormatError.
+// A single png file is written as a PNG without acTL and fcTL, and so is an
+// animation whose other frames were all left out.
+// The acTL and fcTL chunks are corrected afterwards if frames are left out, so
+// if w is not an io.WriteSeeker the animation is held in memory and written
+// to w at the end.
+func Encode(w io.Writer, pngfiles []string, delays []int) error {
+	return EncodeWithOptions(w, pngfiles, delays, nil)
+}
+
+// EncodeWithOptions writes all the png files in frames into the output file w
+// with the given options. The delays are numerators of o.DelayDenominator.
+// A nil *EncodeOptions uses the defaults.
+func EncodeWithOptions(w io.Writer, pngfiles []string, delays []int, o *EncodeOptions) error {
+	fractions, err := fractionDelays(delays, o)
+	if err != nil {
+		return err
+	}
+	return EncodeDelays(w, pngfiles, fractions, o)
+}
+
+// EncodeDelays is like EncodeWithOptions with the delay fraction of every frame
+// given directly, e.g. Delay{1, 60} for 60 fps. The DelayDenominator, TimeBase
+// and SnapTimeBase options are not used.
+func EncodeDelays(w io.Writer, pngfiles []string, delays []Delay, o *EncodeOptions) error {
+	open := func(i int) (io.ReadCloser, error) {
+		return os.Open(pngfiles[i])
+	}
+	return encode(context.Background(), w, pngfiles, open, delays, o)
+}
+
+// EncodeContext is like Encode but stops when ctx is done and returns
+// ctx.Err(). The context is checked between the chunks that are read, w
+// then ends with the last complete chunk that was written and has no IEND.
+func EncodeContext(ctx context.Context, w io.Writer, pngfiles []string, delays []int) error {
+	fractions, err := fractionDelays(delays, nil)
+	if err != nil {
+		return err
+	}
+	open := func(i int) (io.ReadCloser, error) {
+		return os.Open(pngfiles[i])
+	}
+	return encode(ctx, w, pngfiles, open, fractions, nil)
+}
+
+// EncodeDurations is like Encode with the delays given as durations and
+// the loop count, 0 is infinite looping.
+func EncodeDurations(w io.Writer, pngfiles []string, delays []time.Duration, loop int) error {
+	fractions, err := DurationDelays(delays)
+	if err != nil {
+		return err
+	}
+	return EncodeDelays(w, pngfiles, fractions, &EncodeOptions{Loop: loop})
+}
+
+// DurationDelays returns the delay fractions of the durations for EncodeDelays.
+// A duration that cannot be written exactly gets the closest fraction that
+// fits into fcTL, e.g. 1/30 for 33.333333ms, the same way EncodeWithOptions
+// rounds its delays. Durations longer than 65535 seconds or too short for any
+// fraction but 0 are an UnsupportedError.
+func DurationDelays(delays []time.Duration) ([]Delay, error) {
+	fractions := make([]Delay, len(delays))
+	for i, delay := range delays {
+		if delay < 0 {
+			return nil, FormatError(fmt.Sprintf("negative delay %v of frame %d", delay, i))
+		}
+		fractions[i] = fitDelay(uint64(delay), uint64(time.Second))
+		if fractions[i].Den == 0 {
+			return nil, UnsupportedError(fmt.Sprintf("delay %v of frame %d does not fit into fcTL", delay, i))
+		}
+	}
+	return fractions, nil
+}
+
+// EncodeReaders is like Encode with the png files read from frames instead
+// of opened by name, e.g. from a zip archive or the bodies of http responses.
+// The readers are read one after another, or at the same time with
+// EncodeOptions.Concurrency, and are not closed.
+func EncodeReaders(w io.Writer, frames []io.Reader, delays []int) error {
+	return EncodeReadersWithOptions(w, frames, delays, nil)
+}
+
+// EncodeReadersWithOptions is like EncodeReaders with the given options.
+// The delays are numerators of o.DelayDenominator.
+// A nil *EncodeOptions uses the defaults.
+func EncodeReadersWithOptions(w io.Writer, frames []io.Reader, delays []int, o *EncodeOptions) error {
+	names := make([]string, len(frames))
+	for i := range frames {
+		names[i] = "frame " + strconv.Itoa(i)
+	}
+	open := func(i int) (io.ReadCloser, error) {
+		return ioutil.NopCloser(frames[i]), nil
+	}
+	fractions, err := fractionDelays(delays, o)
+	if err != nil {
+		return err
+	}
+	return encode(context.Background(), w, names, open, fractions, o)
+}
+
+// samePixel reports whether the NRGBA pixels a and b look the same,
+// all fully transparent pixels do.
+func samePixel(a, b []uint8) bool {
+	if a[3] == 0 && b[3] == 0 {
+		return true
+	}
+	return a[0] == b[0] && a[1] == b[1] && a[2] == b[2] && a[3] == b[3]
+}
+
+// diffFrames returns the regions of frames that changed since the previous
+// frame, each with its offset, blend op and delay, for the Diff option.
+// offsets is EncodeOptions.Offsets. The first frame of the animation stays
+// whole, that is the second frame with staticDefault. With inferDisposal the
+// dispose ops of the frames are returned as well, otherwise they are nil.
+func diffFrames(frames []image.Image, delays []int, offsets []image.Point, staticDefault, inferDisposal bool) ([]image.Image, []int, []image.Point, []BlendOp, []DisposeOp, error) {
+	if len(delays) < len(frames) {
+		return nil, nil, nil, nil, nil, FormatError(fmt.Sprintf("%d delays for %d frames", len(delays), len(frames)))
+	}
+	if len(offsets) != 0 && len(offsets) < len(frames) {
+		return nil, nil, nil, nil, nil, FormatError(fmt.Sprintf("%d offsets for %d frames", len(offsets), len(frames)))
+	}
+	bounds := frames[0].Bounds()
+	canvas := image.NewNRGBA(bounds)
+	previous := image.NewNRGBA(bounds)
+	// before is the canvas that the last written frame was drawn onto and
+	// last is its region, for the dispose ops of that frame
+	before := image.NewNRGBA(bounds)
+	var last image.Rectangle
+	var outFrames []image.Image
+	var outDelays []int
+	var outOffsets []image.Point
+	var outBlend []BlendOp
+	var outDispose []DisposeOp
+
+	// diff returns the bounding box of the pixels within area that differ
+	// between base and the canvas and whether they are all opaque
+	diff := func(base *image.NRGBA, area image.Rectangle) (image.Rectangle, bool) {
+		changed := image.Rectangle{}
+		opaque := true
+		for y := area.Min.Y; y < area.Max.Y; y++ {
+			for x := area.Min.X; x < area.Max.X; x++ {
+				j := canvas.PixOffset(x, y)
+				if samePixel(canvas.Pix[j:j+4], base.Pix[j:j+4]) {
+					continue
+				}
+				changed = changed.Union(image.Rect(x, y, x+1, y+1))
+				if canvas.Pix[j+3] != 0xff {
+					opaque = false
+				}
+			}
+		}
+		return changed, opaque
+	}
+
+	for i, img := range frames {
+		// The region of the frame on the canvas
+		r := img.Bounds()
+		if len(offsets) != 0 {
+			r = r.Sub(r.Min).Add(bounds.Min.Add(offsets[i]))
+		}
+		if !r.In(bounds) {
+			return nil, nil, nil, nil, nil, FormatError(fmt.Sprintf("frame %d at %v is not within the first frame %v", i, r, bounds))
+		}
+		copy(previous.Pix, canvas.Pix)
+		draw.Draw(canvas, r, img, img.Bounds().Min, draw.Src)
+
+		if i == 0 || (i == 1 && staticDefault) {
+			whole := image.NewNRGBA(bounds)
+			copy(whole.Pix, canvas.Pix)
+			outFrames = append(outFrames, whole)
+			outDelays = append(outDelays, delays[i])
+			outOffsets = append(outOffsets, image.ZP)
+			outBlend = append(outBlend, BlendOpSource)
+			outDispose = append(outDispose, DisposeOpNone)
+			// The first frame of the animation is drawn onto a transparent canvas
+			before = image.NewNRGBA(bounds)
+			last = bounds
+			continue
+		}
+
+		// Bounding box of the changed pixels, with inferDisposal for each
+		// dispose op of the last written frame
+		base := previous
+		dispose := DisposeOpNone
+		changed, opaque := diff(previous, r)
+		if inferDisposal && !changed.Empty() {
+			for _, op := range []DisposeOp{DisposeOpBackground, DisposeOpPrevious} {
+				b := image.NewNRGBA(bounds)
+				copy(b.Pix, previous.Pix)
+				for y := last.Min.Y; y < last.Max.Y; y++ {
+					row := b.Pix[b.PixOffset(last.Min.X, y):b.PixOffset(last.Max.X, y)]
+					if op == DisposeOpBackground {
+						for j := range row {
+							row[j] = 0
+						}
+					} else {
+						copy(row, before.Pix[before.PixOffset(last.Min.X, y):])
+					}
+				}
+				c, o := diff(b, r.Union(last))
+				if c.Empty() {
+					// The dispose op needs a frame, a transparent pixel
+					c, o = image.Rectangle{last.Min, last.Min.Add(image.Pt(1, 1))}, true
+				}
+				if c.Dx()*c.Dy() < changed.Dx()*changed.Dy() {
+					base, dispose, changed, opaque = b, op, c, o
+				}
+			}
+		}
+		if changed.Empty() {
+			outDelays[len(outDelays)-1] += delays[i]
+			continue
+		}
+
+		region := image.NewNRGBA(changed)
+		for y := changed.Min.Y; y < changed.Max.Y; y++ {
+			for x := changed.Min.X; x < changed.Max.X; x++ {
+				j := canvas.PixOffset(x, y)
+				if opaque && samePixel(canvas.Pix[j:j+4], base.Pix[j:j+4]) {
+					// transparent, the previous frame shows through
+					continue
+				}
+				copy(region.Pix[region.PixOffset(x, y):], canvas.Pix[j:j+4])
+			}
+		}
+		blend := BlendOpSource
+		if opaque {
+			blend = BlendOpOver
+		}
+		outFrames = append(outFrames, region)
+		outDelays = append(outDelays, delays[i])
+		outOffsets = append(outOffsets, changed.Min.Sub(bounds.Min))
+		outBlend = append(outBlend, blend)
+		outDispose[len(outDispose)-1] = dispose
+		outDispose = append(outDispose, DisposeOpNone)
+		if base == previous {
+			base = image.NewNRGBA(bounds)
+			copy(base.Pix, previous.Pix)
+		}
+		before, last = base, changed
+	}
+	if !inferDisposal {
+		outDispose = nil
+	}
+	return outFrames, outDelays, outOffsets, outBlend, outDispose, nil
+}
+
+// EncodeImages writes the images in frames as an animation into w.
+// Each image is encoded with image/png and then assembled like the files of Encode,
+// the first image becomes the default image and its bounds are the canvas.
+// The other images may be smaller, they are placed at their Bounds().Min
+// relative to the canvas and have to lie within it. If o.Offsets is set it is
+// used instead of the bounds for the placement.
+// The delays are in 1/100ths of a second.
+func EncodeImages(w io.Writer, frames []image.Image, delays []int) error {
+	return EncodeImagesWithOptions(w, frames, delays, nil)
+}
+
+// EncodeImagesWithOptions is like EncodeImages with the given options,
+// e.g. the loop count. The delays are numerators of o.DelayDenominator.
+// A nil *EncodeOptions uses the defaults.
+func EncodeImagesWithOptions(w io.Writer, frames []image.Image, delays []int, o *EncodeOptions) error {
+	if o != nil && o.PosterImage != nil {
+		if len(frames) == 0 {
+			return FormatError("no frames, an animation needs at least one frame")
+		}
+		if o.StaticDefault {
+			return FormatError("PosterImage cannot be combined with StaticDefault")
+		}
+		canvas := frames[0].Bounds()
+		if o.PosterImage.Bounds().Size() != canvas.Size() {
+			return FormatError(fmt.Sprintf("the poster image is %v but the first frame is %v", o.PosterImage.Bounds().Size(), canvas.Size()))
+		}
+		// The poster becomes the first frame, moved onto the canvas
+		poster := *toNRGBA(o.PosterImage)
+		poster.Rect = canvas
+		frames = append([]image.Image{&poster}, frames...)
+		if len(delays) < len(frames)-1 {
+			return FormatError(fmt.Sprintf("%d delays for %d frames", len(delays), len(frames)-1))
+		}
+		delays = append([]int{0}, delays...)
+		opts := *o
+		opts.PosterImage = nil
+		opts.StaticDefault = true
+		if o.Offsets != nil {
+			opts.Offsets = append([]image.Point{{}}, o.Offsets...)
+		}
+		if o.Dispose != nil {
+			opts.Dispose = append([]DisposeOp{DisposeOpNone}, o.Dispose...)
+		}
+		if o.Blend != nil {
+			opts.Blend = append([]BlendOp{BlendOpSource}, o.Blend...)
+		}
+		if progress := o.Progress; progress != nil {
+			opts.Progress = func(frameIndex int, filename string) {
+				if frameIndex > 0 {
+					progress(frameIndex-1, "frame "+strconv.Itoa(frameIndex-1))
+				}
+			}
+		}
+		o = &opts
+	}
+	if o != nil && (o.Diff || o.InferDisposal) && len(frames) > 0 {
+		opts := *o
+		var err error
+		frames, delays, opts.Offsets, opts.Blend, opts.Dispose, err = diffFrames(frames, delays, o.Offsets, o.StaticDefault, o.InferDisposal)
+		if err != nil {
+			return err
+		}
+		opts.Diff = false
+		opts.InferDisposal = false
+		o = &opts
+	}
+	fractions, err := fractionDelays(delays, o)
+	if err != nil {
+		return err
+	}
+	return encodeImages(w, frames, fractions, o)
+}
+
+// encodeImages is EncodeImagesWithOptions after PosterImage and Diff with the
+// delays as fractions.
+func encodeImages(w io.Writer, frames []image.Image, fractions []Delay, o *EncodeOptions) error {
+	var trns []byte // tRNS data of the first frame with OptimizeAlpha
+	if o != nil && o.OptimizeAlpha {
+		if keyed, key := keyTransparent(frames); keyed != nil {
+			frames, trns = keyed, key
+		}
+	}
+	names := make([]string, len(frames))
+	var offsets []image.Point
+	if o == nil || o.Offsets == nil {
+		offsets = make([]image.Point, len(frames))
+	}
+	opaque := 0
+	sub := false // a frame has other bounds than the first frame
+	for i, img := range frames {
+		if offsets != nil {
+			sub = sub || img.Bounds() != frames[0].Bounds()
+			if !img.Bounds().In(frames[0].Bounds()) {
+				return FormatError(fmt.Sprintf("frame %d has the bounds %v which are not within the first frame %v", i, img.Bounds(), frames[0].Bounds()))
+			}
+			offsets[i] = img.Bounds().Min.Sub(frames[0].Bounds().Min)
+		}
+		names[i] = "frame " + strconv.Itoa(i)
+		// The frames are encoded as *image.NRGBA, which is what image/png
+		// sees, an image of another type may not tell if it is opaque
+		if toNRGBA(img).Opaque() {
+			opaque++
+		}
+	}
+	// image/png leaves out the alpha channel of opaque images, so if only
+	// some frames are opaque all of them are written with an alpha channel
+	mixed := opaque != 0 && opaque != len(frames)
+	open := func(i int) (io.ReadCloser, error) {
+		var b bytes.Buffer
+		var err error
+		if mixed {
+			err = writeNRGBA(&b, toNRGBA(frames[i]))
+		} else {
+			err = png.Encode(&b, toNRGBA(frames[i]))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 && trns != nil {
+			// The tRNS chunk goes after IHDR, which has 13 bytes of data
+			var chunk bytes.Buffer
+			h := &encoder{w: &chunk}
+			h.writeChunk(trns, "tRNS")
+			head := b.Next(len(pngHeader) + 12 + 13)
+			return ioutil.NopCloser(io.MultiReader(bytes.NewReader(head), &chunk, &b)), nil
+		}
+		return ioutil.NopCloser(&b), nil
+	}
+	if sub {
+		opts := EncodeOptions{}
+		if o != nil {
+			opts = *o
+		}
+		opts.Offsets = offsets
+		o = &opts
+	}
+	return encode(context.Background(), w, names, open, fractions, o)
+}
+
+// keyTransparent returns copies of the frames whose transparent pixels have an
+// opaque color that no opaque pixel has, and the tRNS data of color type 2 for
+// that color. It returns nil if a pixel is translucent, if no pixel is
+// transparent or if every color is used.
+func keyTransparent(frames []image.Image) ([]image.Image, []byte) {
+	used := make([]uint64, 1<<24/64) // a bit for every color of the opaque pixels
+	transparent := false
+	nrgba := make([]*image.NRGBA, len(frames))
+	for i, img := range frames {
+		m := toNRGBA(img)
+		nrgba[i] = m
+		b := m.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			row := m.Pix[m.PixOffset(b.Min.X, y):m.PixOffset(b.Max.X, y)]
+			for j := 0; j < len(row); j += 4 {
+				switch row[j+3] {
+				case 0:
+					transparent = true
+				case 0xff:
+					c := uint32(row[j])<<16 | uint32(row[j+1])<<8 | uint32(row[j+2])
+					used[c/64] |= 1 << (c % 64)
+				default:
+					return nil, nil
+				}
+			}
+		}
+	}
+	if !transparent {
+		return nil, nil
+	}
+	for i, u := range used {
+		if u == ^uint64(0) {
+			continue
+		}
+		c := uint32(i*64 + bits.TrailingZeros64(^u))
+		key := [3]uint8{uint8(c >> 16), uint8(c >> 8), uint8(c)}
+		keyed := make([]image.Image, len(frames))
+		for n, m := range nrgba {
+			k := image.NewNRGBA(m.Bounds())
+			draw.Draw(k, k.Bounds(), m, m.Bounds().Min, draw.Src)
+			for j := 0; j < len(k.Pix); j += 4 {
+				if k.Pix[j+3] == 0 {
+					k.Pix[j], k.Pix[j+1], k.Pix[j+2], k.Pix[j+3] = key[0], key[1], key[2], 0xff
+				}
+			}
+			keyed[n] = k
+		}
+		return keyed, []byte{0, key[0], 0, key[1], 0, key[2]}
+	}
+	return nil, nil
+}
+
+// EncodeImagesFunc is like EncodeImagesWithOptions with the delay of every
+// frame returned by delay, e.g. for eased animations. delay is called once for
+// every frame in order before anything is written. The durations are written
+// the way DurationDelays writes them, so DelayDenominator and TimeBase are not
+// used, SnapTimeBase rounds them like other delays in TimeBase.
+func EncodeImagesFunc(w io.Writer, frames []image.Image, delay func(frameIndex int) time.Duration, o *EncodeOptions) error {
+	delays := make([]int, len(frames))
+	for i := range frames {
+		d := delay(i)
+		if d < 0 {
+			return FormatError(fmt.Sprintf("negative delay %v of frame %d", d, i))
+		}
+		if int64(int(d)) != int64(d) {
+			return UnsupportedError(fmt.Sprintf("delay %v of frame %d is too long", d, i))
+		}
+		delays[i] = int(d)
+	}
+	// The delays are nanoseconds
+	opts := EncodeOptions{}
+	if o != nil {
+		opts = *o
+	}
+	opts.TimeBase = Rational{1, uint32(time.Second)}
+	return EncodeImagesWithOptions(w, frames, delays, &opts)
+}
+
+// EncodeGIF converts the animated GIF g into an APNG. The frames are drawn
+// onto the canvas and disposed of the way GIF does it, so every frame of the
+// APNG is the whole canvas as it is shown, and a viewer does not need to
+// dispose of anything. The background of the canvas is transparent like in
+// the browsers. The delays in 1/100ths of a second and the loop count are kept.
+func EncodeGIF(w io.Writer, g *gif.GIF) error {
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() {
+		for _, img := range g.Image {
+			bounds = bounds.Union(img.Bounds())
+		}
+	}
+	canvas := image.NewRGBA(bounds)
+	frames := make([]image.Image, len(g.Image))
+	for i, img := range g.Image {
+		disposal := byte(gif.DisposalNone)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(bounds)
+			copy(previous.Pix, canvas.Pix)
+		}
+		draw.Draw(canvas, img.Bounds(), img, img.Bounds().Min, draw.Over)
+		frame := image.NewRGBA(bounds)
+		copy(frame.Pix, canvas.Pix)
+		frames[i] = frame
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, img.Bounds(), image.Transparent, image.ZP, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	delays := make([]int, len(g.Image))
+	copy(delays, g.Delay)
+
+	// GIF counts the repetitions after the first play, -1 plays it once
+	o := &EncodeOptions{}
+	switch {
+	case g.LoopCount < 0:
+		o.Loop = 1
+	case g.LoopCount > 0:
+		o.Loop = g.LoopCount + 1
+	}
+	return EncodeImagesWithOptions(w, frames, delays, o)
+}
+
+// EncodeToBytes is like EncodeImages but returns the animation instead of
+// writing it, e.g. for an http response or a cache.
+func EncodeToBytes(frames []image.Image, delays []int) ([]byte, error) {
+	var b bytes.Buffer
+	if err := EncodeImages(&b, frames, delays); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Encoder writes an animation frame by frame, for animations whose frames
+// are not all available at once.
+//
+// The number of frames in acTL is only known on Close. If w is an
+// io.WriteSeeker, e.g. an *os.File, Close writes it into the acTL chunk,
+// otherwise Frames has to be set to the number of frames before the first
+// AddFrame.
+type Encoder struct {
+	// Frames, if not 0, is the number of frames written into acTL. Close
+	// returns a FormatError if a different number of frames was added.
+	Frames int
+
+	// Context, if not nil, is checked by AddFrame and AddRawFrame before and
+	// while they write a frame. Once it is done its error is returned and the
+	// Encoder cannot be used any more.
+	Context context.Context
+
+	e      *encoder
+	width  int
+	height int
+	loop   int
+	added  int // number of frames added so far
+	closed bool
+}
+
+// NewEncoder returns an Encoder that writes an animation of canvasW x canvasH
+// pixels into w, looping loop times, 0 is infinite looping.
+// Nothing is written before the first frame is added.
+func NewEncoder(w io.Writer, canvasW, canvasH, loop int) *Encoder {
+	return &Encoder{
+		e: &encoder{
+			w:         w,
+			subFrames: true,
+		},
+		width:  canvasW,
+		height: canvasH,
+		loop:   loop,
+	}
+}
+
+// AddFrame encodes img as the next frame with a delay in 1/100ths of a second.
+// The image is placed at img.Bounds().Min and has to lie within the canvas,
+// the first frame is the default image and has to cover the whole canvas.
+// All frames are written with an alpha channel because the color type of the
+// first frame is used for all of them.
+func (enc *Encoder) AddFrame(img image.Image, delay int) error {
+	e := enc.e
+	if e.err != nil {
+		return e.err
+	}
+	if enc.closed {
+		return FormatError("AddFrame after Close")
+	}
+	if e.ctx = enc.Context; e.canceled() {
+		return e.err
+	}
+	canvas := image.Rect(0, 0, enc.width, enc.height)
+	b := img.Bounds()
+	if enc.added == 0 && b != canvas {
+		return FormatError(fmt.Sprintf("the first frame has the bounds %v but the canvas is %v", b, canvas))
+	}
+	if !b.In(canvas) {
+		return FormatError(fmt.Sprintf("frame %d has the bounds %v which are not within the canvas %v", enc.added, b, canvas))
+	}
+	if enc.loop < 0 {
+		return FormatError("negative loop count: " + strconv.Itoa(enc.loop))
+	}
+	fractions, err := fractionDelays([]int{delay}, nil)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := writeNRGBA(&buf, toNRGBA(img)); err != nil {
+		return err
+	}
+	name := "frame " + strconv.Itoa(enc.added)
+	fc := frameControl{
+		width:    b.Dx(),
+		height:   b.Dy(),
+		xOffset:  b.Min.X,
+		yOffset:  b.Min.Y,
+		delayNum: fractions[0].Num,
+		delayDen: fractions[0].Den,
+	}
+	if enc.added == 0 {
+		enc.writeHeader(&buf, name, fc)
+	} else {
+		e.writeFDAT(&buf, name, fc)
+	}
+	enc.added++
+	return e.err
+}
+
+// AddRawFrame adds a frame whose image data is already compressed, with a
+// delay in 1/100ths of a second. compressedIDAT is written into fdAT chunks
+// as it is, it is not decoded or checked. It has to be the zlib stream of a
+// non-interlaced image of w x h pixels with bit depth 8 and color type 6,
+// the format AddFrame writes: every scanline is a filter type byte followed
+// by R, G, B and A of every pixel, one byte each and not premultiplied.
+// The frame is placed at 0, 0 and has to fit into the canvas, the first frame
+// is the default image and has to have the size of the canvas.
+func (enc *Encoder) AddRawFrame(compressedIDAT []byte, w, h int32, delay int) error {
+	e := enc.e
+	if e.err != nil {
+		return e.err
+	}
+	if enc.closed {
+		return FormatError("AddRawFrame after Close")
+	}
+	if e.ctx = enc.Context; e.canceled() {
+		return e.err
+	}
+	if enc.added == 0 && (int(w) != enc.width || int(h) != enc.height) {
+		return FormatError(fmt.Sprintf("the first frame is %d x %d but the canvas is %d x %d", w, h, enc.width, enc.height))
+	}
+	if w <= 0 || h <= 0 || int(w) > enc.width || int(h) > enc.height {
+		return FormatError(fmt.Sprintf("frame %d is %d x %d which does not fit into the canvas of %d x %d", enc.added, w, h, enc.width, enc.height))
+	}
+	if len(compressedIDAT) == 0 {
+		return FormatError(fmt.Sprintf("frame %d has no image data", enc.added))
+	}
+	if enc.loop < 0 {
+		return FormatError("negative loop count: " + strconv.Itoa(enc.loop))
+	}
+	fractions, err := fractionDelays([]int{delay}, nil)
+	if err != nil {
+		return err
+	}
+
+	name := "frame " + strconv.Itoa(enc.added)
+	fc := frameControl{
+		width:    int(w),
+		height:   int(h),
+		delayNum: fractions[0].Num,
+		delayDen: fractions[0].Den,
+	}
+	if enc.added == 0 {
+		// The default image needs the IHDR, it is written like a frame of AddFrame
+		var buf bytes.Buffer
+		if err := writeRawNRGBA(&buf, int(w), int(h), compressedIDAT); err != nil {
+			return err
+		}
+		enc.writeHeader(&buf, name, fc)
+	} else {
+		// Split the data into fdAT chunks of the size writeFDAT fills them up to
+		e.pending = &fc
+		limit := e.maxChunkSize() - 5*4 - 16
+		for data := compressedIDAT; len(data) > 0 && e.err == nil && !e.canceled(); {
+			n := min(limit, len(data))
+			e.writeFDATChunk(data[:n])
+			data = data[n:]
+		}
+	}
+	enc.added++
+	return e.err
+}
+
+// writeHeader writes the png header, IHDR, acTL and the first frame r.
+func (enc *Encoder) writeHeader(r io.Reader, name string, fc frameControl) {
+	e := enc.e
+	d := &decoder{
+		r:   bufio.NewReader(r),
+		crc: crc32.NewIEEE(),
+	}
+	if e.err = d.checkHeader(); e.err != nil {
+		return
+	}
+	length, err := d.parseChunk()
+	if err != nil || d.ChunkName != "IHDR" || length != 13+12 {
+		e.err = FormatError("could not read IHDR of " + name)
+		return
+	}
+	e.width, e.height = enc.width, enc.height
+	e.bitDepth, e.colorType = d.tmp[16], d.tmp[17]
+
+	if s, ok := e.w.(io.WriteSeeker); ok && enc.Frames == 0 {
+		e.seeker = s
+		e.actl, e.err = s.Seek(0, io.SeekCurrent)
+		e.actl += int64(len(pngHeader)) + int64(length)
+	} else if enc.Frames == 0 {
+		e.err = UnsupportedError("the number of frames has to be set in Encoder.Frames if the writer is not an io.WriteSeeker")
+	}
+	if e.err != nil {
+		return
+	}
+
+	_, e.err = io.WriteString(e.w, pngHeader)
+	if e.err == nil {
+		_, e.err = e.w.Write(d.tmp[0:length])
+	}
+	frames := enc.Frames
+	if frames == 0 {
+		// Placeholder, Close writes the number of frames
+		frames = 1
+	}
+	e.writeACTL(frames, enc.loop)
+	e.copyIDAT(d, name, fc, true)
+}
+
+// Close writes the end of the animation. It does not close the underlying
+// writer, but flushes it if it has a Flush method like *bufio.Writer and
+// returns the error of Flush.
+func (enc *Encoder) Close() error {
+	e := enc.e
+	if e.err != nil || enc.closed {
+		return e.err
+	}
+	enc.closed = true
+	if enc.added == 0 {
+		return FormatError("no frames, an animation needs at least one frame")
+	}
+	e.writeIEND()
+	if e.err != nil {
+		return e.err
+	}
+	if enc.Frames != 0 {
+		if enc.Frames != enc.added {
+			e.err = FormatError(fmt.Sprintf("%d frames were added but Encoder.Frames is %d", enc.added, enc.Frames))
+		}
+	} else {
+		// Write the number of frames into the acTL chunk
+		e.rewriteACTL(enc.loop)
+	}
+	if f, ok := e.w.(interface {
+		Flush() error
+	}); ok && e.err == nil {
+		e.err = f.Flush()
+	}
+	return e.err
+}
+
+// toNRGBA converts img to *image.NRGBA so that image/png encodes all frames with the same IHDR.
+func toNRGBA(img image.Image) *image.NRGBA {
+	if m, ok := img.(*image.NRGBA); ok {
+		return m
+	}
+	if m, ok := img.(*image.NRGBA64); ok {
+		// draw.Draw would premultiply the colors
+		return canvasFrame(m, false).(*image.NRGBA)
+	}
+	m := image.NewNRGBA(img.Bounds())
+	draw.Draw(m, m.Bounds(), img, img.Bounds().Min, draw.Src)
+	return m
+}
+
+// writeNRGBA writes img as a PNG file with color type 6 (truecolor with alpha)
+// even if it is opaque. The scanlines are not filtered.
+func writeNRGBA(w io.Writer, img *image.NRGBA) error {
+	b := img.Bounds()
+	var data bytes.Buffer
+	zw := zlib.NewWriter(&data)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		zw.Write([]byte{0}) // filter type None
+		i := img.PixOffset(b.Min.X, y)
+		zw.Write(img.Pix[i : i+4*b.Dx()])
+	}
+	zw.Close()
+	return writeRawNRGBA(w, b.Dx(), b.Dy(), data.Bytes())
+}
+
+// writeRawNRGBA writes a PNG file of width x height pixels with color type 6
+// and bit depth 8 whose image data is the zlib stream data.
+func writeRawNRGBA(w io.Writer, width, height int, data []byte) error {
+	e := &encoder{
+		w: w,
+	}
+
+	_, e.err = io.WriteString(w, pngHeader)
+
+	var ihdr [13]byte
+	writeUint32(ihdr[0:4], uint32(width))
+	writeUint32(ihdr[4:8], uint32(height))
+	ihdr[8] = 8 // bit depth
+	ihdr[9] = 6 // color type
+	e.writeChunk(ihdr[:], "IHDR")
+	e.writeChunk(data, "IDAT")
+
+	e.writeIEND()
+	return e.err
+}
+
+// writeConverted writes img as a png file with the given bit depth and color
+// type. pal is the palette for color type 3. The image data is not filtered.
+func writeConverted(w io.Writer, img image.Image, bitDepth, colorType uint8, pal color.Palette) error {
+	valid := false
+	switch colorType {
+	case 0:
+		valid = bitDepth == 1 || bitDepth == 2 || bitDepth == 4 || bitDepth == 8 || bitDepth == 16
+	case 3:
+		valid = (bitDepth == 1 || bitDepth == 2 || bitDepth == 4 || bitDepth == 8) && len(pal) > 0
+	case 2, 4, 6:
+		valid = bitDepth == 8 || bitDepth == 16
+	}
+	if !valid {
+		return UnsupportedError(fmt.Sprintf("bit depth %d and color type %d", bitDepth, colorType))
+	}
+
+	e := &encoder{
+		w: w,
+	}
+	b := img.Bounds()
+
+	_, e.err = io.WriteString(w, pngHeader)
+
+	var ihdr [13]byte
+	writeUint32(ihdr[0:4], uint32(b.Dx()))
+	writeUint32(ihdr[4:8], uint32(b.Dy()))
+	ihdr[8] = bitDepth
+	ihdr[9] = colorType
+	e.writeChunk(ihdr[:], "IHDR")
+
+	// samples returns the samples of the pixel at x, y as 16 bit values, or the palette index
+	samples := func(x, y int, s []uint32) []uint32 {
+		c := img.At(x, y)
+		switch colorType {
+		case 0:
+			return append(s, uint32(color.Gray16Model.Convert(c).(color.Gray16).Y))
+		case 3:
+			return append(s, uint32(pal.Index(c)))
+		}
+		n := nrgba64(c)
+		switch colorType {
+		case 2:
+			return append(s, uint32(n.R), uint32(n.G), uint32(n.B))
+		case 4:
+			gray := (19595*uint32(n.R) + 38470*uint32(n.G) + 7471*uint32(n.B) + 1<<15) >> 16
+			return append(s, gray, uint32(n.A))
+		}
+		return append(s, uint32(n.R), uint32(n.G), uint32(n.B), uint32(n.A))
+	}
+
+	var data bytes.Buffer
+	zw := zlib.NewWriter(&data)
+	var s []uint32
+	var row []byte
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row = append(row[:0], 0) // filter type None
+		var bits, n uint32       // pending bits of a byte for bit depths below 8
+		for x := b.Min.X; x < b.Max.X; x++ {
+			s = samples(x, y, s[:0])
+			for _, v := range s {
+				switch {
+				case bitDepth == 16:
+					row = append(row, uint8(v>>8), uint8(v))
+				case colorType == 3:
+					bits, n = bits<<bitDepth|v, n+uint32(bitDepth)
+				default:
+					bits, n = bits<<bitDepth|v>>(16-bitDepth), n+uint32(bitDepth)
+				}
+				if n == 8 {
+					row = append(row, uint8(bits))
+					bits, n = 0, 0
+				}
+			}
+		}
+		if n > 0 {
+			row = append(row, uint8(bits<<(8-n)))
+		}
+		zw.Write(row)
+	}
+	zw.Close()
+	e.writeChunk(data.Bytes(), "IDAT")
+
+	e.writeIEND()
+	return e.err
+}
+
+// encode writes the animation of the frames returned by open into w.
+// names are used in messages and errors, there is one for every frame.
+func encode(ctx context.Context, w io.Writer, names []string, open func(i int) (io.ReadCloser, error), delays []Delay, o *EncodeOptions) error {
+	// acTL num_frames must be at least 1
+	if len(names) == 0 {
+		return FormatError("no frames, an animation needs at least one frame")
+	}
+	if s, ok := w.(io.WriteSeeker); len(names) > 1 && (!ok || !canSeek(s)) {
+		// The chunks are corrected in memory and written to w afterwards,
+		// what was written before an error is written as well
+		var m memFile
+		err := encode(ctx, &m, names, open, delays, o)
+		if _, werr := w.Write(m.b); err == nil {
+			err = werr
+		}
+		return err
+	}
+	if len(delays) < len(names) {
+		return FormatError(fmt.Sprintf("%d delays for %d frames", len(delays), len(names)))
+	}
+	if o != nil && o.Context != nil {
+		ctx = o.Context
+	}
+	loop := 0
+	staticDefault := false
+	concurrency := 0
+	var progress func(frameIndex int, filename string)
+	if o != nil {
+		loop = o.Loop
+		staticDefault = o.StaticDefault
+		progress = o.Progress
+		concurrency = o.Concurrency
+	}
+	// number of frames in the animation, a single png file is written as
+	// a PNG without animation
+	numFrames := len(names)
+	if staticDefault {
+		numFrames--
+	}
+	if len(names) == 1 {
+		numFrames = 0
+	}
+	if loop < 0 {
+		return FormatError("negative loop count: " + strconv.Itoa(loop))
+	}
+	var dispose []DisposeOp
+	var blend []BlendOp
+	var offsets []image.Point
+	if o != nil {
+		dispose, blend, offsets = o.Dispose, o.Blend, o.Offsets
+	}
+	if len(offsets) != 0 && len(offsets) < len(names) {
+		return FormatError(fmt.Sprintf("%d offsets for %d frames", len(offsets), len(names)))
+	}
+	for i := range offsets {
+		if offsets[i].X < 0 || offsets[i].Y < 0 {
+			return FormatError(fmt.Sprintf("negative offset %v of frame %d", offsets[i], i))
+		}
+	}
+	if len(offsets) != 0 && offsets[0] != image.ZP {
+		return FormatError(fmt.Sprintf("offset %v of the first frame, the default image has to be at 0, 0", offsets[0]))
+	}
+	if len(dispose) != 0 && len(dispose) < len(names) {
+		return FormatError(fmt.Sprintf("%d dispose ops for %d frames", len(dispose), len(names)))
+	}
+	if len(blend) != 0 && len(blend) < len(names) {
+		return FormatError(fmt.Sprintf("%d blend ops for %d frames", len(blend), len(names)))
+	}
+	for i := range dispose {
+		if dispose[i] > DisposeOpPrevious {
+			return FormatError(fmt.Sprintf("invalid dispose op %d of frame %d", dispose[i], i))
+		}
+	}
+	for i := range blend {
+		if blend[i] > BlendOpOver {
+			return FormatError(fmt.Sprintf("invalid blend op %d of frame %d", blend[i], i))
+		}
+	}
+	var text map[string]string
+	if o != nil {
+		text = o.Text
+		if o.ChunkSize != 0 && o.ChunkSize < minChunkSize {
+			return FormatError(fmt.Sprintf("chunk size %d is too small, it has to be at least %d bytes", o.ChunkSize, minChunkSize))
+		}
+	}
+	for key, value := range text {
+		if !validKeyword(key) {
+			return FormatError(fmt.Sprintf("invalid text keyword %q", key))
+		}
+		if !validText(value) {
+			return FormatError(fmt.Sprintf("invalid text of keyword %q, it has to be UTF-8 without NUL", key))
+		}
+	}
+
+	e := &encoder{
+		w:         w,
+		ctx:       ctx,
+		subFrames: len(offsets) != 0,
+	}
+	if o != nil {
+		e.compatibility = o.Compatibility
+		e.skipCRC = o.SkipCRC
+		e.transcode = o.Transcode
+		e.recompress = o.Recompress
+		e.level = zlibLevel(o.CompressionLevel)
+		e.chunkSize = o.ChunkSize
+		e.dedup = o.MergeDuplicates
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Open first frame
+	r, err := open(0)
+	if err != nil {
+		return fmt.Errorf("could not open first frame %s: %v", names[0], err)
+	}
+	defer r.Close()
+
+	d := &decoder{
+		r:       bufio.NewReader(r),
+		crc:     crc32.NewIEEE(),
+		skipCRC: e.skipCRC,
+	}
+
+	var length uint32 // chunk length
+
+	// check header of first frame
+	if err := d.checkHeader(); err != nil {
+		return fmt.Errorf("no PNG header found in %s: %v", names[0], err)
+	}
+
+	// Copy IHDR from first frame to output
+	length, err = d.parseChunk()
+	if err != nil || d.ChunkName != "IHDR" || length != 13+12 {
+		return FormatError("could not read IHDR of " + names[0])
+	}
+	width := int(binary.BigEndian.Uint32(d.tmp[8:12]))
+	height := int(binary.BigEndian.Uint32(d.tmp[12:16]))
+	e.width, e.height = width, height
+	e.bitDepth, e.colorType = d.tmp[16], d.tmp[17]
+
+	// The image data of an interlaced frame is structured differently, the
+	// output is never interlaced, so the first frame is transcoded
+	var ihdr []byte
+	if d.tmp[20] != 0 {
+		if !e.transcode {
+			return UnsupportedError(names[0] + " is interlaced")
+		}
+		ihdr = append([]byte(nil), d.tmp[:length]...)
+	}
+
+	// frame returns the fcTL content of frame i,
+	// writeFDAT replaces the size with the one of the frame
+	frame := func(i int) frameControl {
+		fc := frameControl{
+			width:    width,
+			height:   height,
+			delayNum: delays[i].Num,
+			delayDen: delays[i].Den,
+		}
+		if len(offsets) != 0 {
+			fc.xOffset, fc.yOffset = offsets[i].X, offsets[i].Y
+		}
+		if len(dispose) != 0 {
+			fc.disposeOp = dispose[i]
+		}
+		if len(blend) != 0 {
+			fc.blendOp = blend[i]
+		}
+		return fc
+	}
+
+	// Remember where acTL goes in case frames without image data have to be left out
+	if s, ok := w.(io.WriteSeeker); ok {
+		if pos, err := s.Seek(0, io.SeekCurrent); err == nil {
+			e.seeker, e.actl = s, pos+int64(len(pngHeader))+int64(length)
+		}
+	}
+
+	// Write png header and IHDR to output
+	_, e.err = e.w.Write([]byte(pngHeader))
+	if ihdr != nil {
+		data := append([]byte(nil), ihdr[8:21]...)
+		data[12] = 0 // not interlaced
+		e.writeChunk(data, "IHDR")
+	} else if e.err == nil {
+		_, e.err = e.w.Write(d.tmp[0:length])
+	}
+
+	// Keep the oFFs chunk of the first frame, it has to be written before the first IDAT.
+	// The palette and color space chunks are kept as they are, in their original order
+	var offs []byte
+	var extra []byte
+	for {
+		_, name, err := d.peekChunk()
+		if err != nil || name == "IDAT" || name == "IEND" {
+			break
+		}
+		length, err = d.parseChunk()
+		if err != nil {
+			return inputError(names[0], err)
+		}
+		switch d.ChunkName {
+		case "oFFs":
+			if length == 9+12 {
+				offs = append([]byte(nil), d.tmp[8:17]...)
+			}
+		case "PLTE", "tRNS", "gAMA", "cHRM", "sRGB", "iCCP":
+			extra = append(extra, d.tmp[:length]...)
+		case "tEXt", "iTXt":
+			if _, ok := text[textKeyword(d.tmp[8:length-4])]; !ok {
+				extra = append(extra, d.tmp[:length]...)
+			}
+		}
+		switch d.ChunkName {
+		case "PLTE":
+			e.plte = append([]byte(nil), d.tmp[8:length-4]...)
+		case "tRNS":
+			e.trns = append([]byte(nil), d.tmp[8:length-4]...)
+		}
+	}
+	if o != nil && o.PageOffset != nil {
+		offs = make([]byte, 9)
+		writeUint32(offs[0:4], uint32(o.PageOffset.X))
+		writeUint32(offs[4:8], uint32(o.PageOffset.Y))
+		offs[8] = o.PageOffset.Unit
+	}
+
+	if progress != nil {
+		progress(0, names[0])
+	}
+
+	// Write ACTL chunk
+	if numFrames > 0 {
+		e.writeACTL(numFrames, loop)
+	}
+
+	if e.err == nil && len(extra) > 0 {
+		_, e.err = e.w.Write(extra)
+	}
+	e.writeText(text)
+
+	if offs != nil {
+		e.writeChunk(offs, "oFFs")
+	}
+
+	// Write first image
+	if ihdr != nil {
+		d, err = e.deinterlace(d, names[0], ihdr)
+		if err != nil {
+			return err
+		}
+	}
+	if e.recompress {
+		d, err = e.recompressed(d)
+		if err != nil {
+			return inputError(names[0], err)
+		}
+	}
+	if e.dedup {
+		e.digest = sha256.New()
+	}
+	// Remember where the fcTL of the first frame goes in case it becomes the only frame
+	var fctl int64
+	if e.seeker != nil && e.err == nil {
+		fctl, e.err = e.seeker.Seek(0, io.SeekCurrent)
+	}
+	e.copyIDAT(d, names[0], frame(0), numFrames > 0 && !staticDefault)
+	if e.dedup {
+		fc := frame(0)
+		e.last = frameDigest(e.digest, &fc)
+		e.digest = nil
+	}
+
+	// Read/Write the other files
+	if concurrency > 1 && e.err == nil {
+		e.writeFramesConcurrently(concurrency, names, open, frame, progress)
+	}
+	for i := 1; i < len(names) && e.err == nil && concurrency <= 1 && !e.canceled(); i++ {
+		if progress != nil {
+			progress(i, names[i])
+		}
+		if e.dedup {
+			// The frame is compared to the one before before it is written
+			p := e.prepareFrame(names[i], func() (io.ReadCloser, error) { return open(i) }, frame(i))
+			if p.err != nil {
+				return p.err
+			}
+			e.writePrepared(p)
+			continue
+		}
+		r, err := open(i)
+		if err != nil {
+			return fmt.Errorf("could not open frame %s: %v", names[i], err)
+		}
+		e.writeFDAT(r, names[i], frame(i))
+		r.Close()
+	}
 
-	flag.Parse()
+	// Write End chunk
+	e.writeIEND()
 
-	globaldelay := 100 // unit is ms
+	switch {
+	case numFrames == 0:
+	case e.frames == 1 && numFrames > 1 && !staticDefault && e.err == nil:
+		// All the other frames were left out, the output becomes a PNG
+		// without animation if the chunks can be removed again
+		if f, ok := w.(truncater); ok && e.seeker != nil {
+			e.removeAnimation(f, fctl)
+		} else {
+			e.rewriteACTL(loop)
+		}
+	case e.frames != numFrames:
+		// Frames without image data were left out
+		e.rewriteACTL(loop)
+	}
+	return e.err
+}
 
-	// Read the delays
-	readdelays := make([]int, 0)
-	f, err := os.Open(delayfile)
+// Append adds the png files newFrames as frames to the end of the APNG dst.
+// The new frames are placed at 0, 0 and have to have the size of the canvas
+// and the bit depth and color type of dst. The delays are in 1/100ths of a
+// second. The number of frames in acTL is updated and the loop count is kept.
+// dst is read from its current position, which has to be the start of the APNG.
+func Append(dst io.ReadWriteSeeker, newFrames []string, delays []int) error {
+	if len(delays) < len(newFrames) {
+		return FormatError(fmt.Sprintf("%d delays for %d frames", len(delays), len(newFrames)))
+	}
+	fractions, err := fractionDelays(delays, nil)
 	if err != nil {
-		fmt.Printf("error opening file: %v\n", err)
-	} else {
-		r := bufio.NewReader(f)
-		s, e := Readln(r)
-		for e == nil {
-			i, e2 := strconv.Atoi(s)
-			if e2 == nil {
-				readdelays = append(readdelays, i/10)
+		return err
+	}
+
+	start, err := dst.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	d := &decoder{
+		r:   bufio.NewReader(dst),
+		crc: crc32.NewIEEE(),
+	}
+	if err := d.checkHeader(); err != nil {
+		return err
+	}
+
+	e := &encoder{
+		w:      dst,
+		seeker: dst,
+		actl:   -1,
+	}
+	loop := 0
+	var next uint32 // sequence number of the next animation chunk
+	pos := start + int64(len(pngHeader))
+	for {
+		length, err := d.readChunkHeader()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		if d.ChunkName == "IEND" {
+			break
+		}
+		switch d.ChunkName {
+		case "IHDR", "acTL", "fcTL", "fdAT":
+			err = d.readChunkBody(length)
+		default:
+			err = d.skipChunkBody(length)
+		}
+		if err != nil {
+			return err
+		}
+		data := d.tmp[8 : length-4]
+		switch d.ChunkName {
+		case "IHDR":
+			if len(data) != 13 {
+				return FormatError("bad IHDR length")
+			}
+			e.width = int(binary.BigEndian.Uint32(data[0:4]))
+			e.height = int(binary.BigEndian.Uint32(data[4:8]))
+			e.bitDepth, e.colorType = data[8], data[9]
+			if data[12] != 0 {
+				return UnsupportedError("interlaced APNG")
+			}
+		case "acTL":
+			if len(data) != 8 {
+				return FormatError("bad acTL length")
 			}
-			s, e = Readln(r)
+			e.actl = pos
+			e.frames = int(binary.BigEndian.Uint32(data[0:4]))
+			loop = int(binary.BigEndian.Uint32(data[4:8]))
+		case "fcTL", "fdAT":
+			if len(data) < 4 {
+				return FormatError("bad " + d.ChunkName + " length")
+			}
+			if n := binary.BigEndian.Uint32(data[0:4]); n >= next {
+				next = n + 1
+			}
+		}
+		pos += int64(length)
+	}
+	if e.actl < 0 {
+		return FormatError("not an APNG, there is no acTL chunk")
+	}
+
+	// Overwrite IEND with the new frames
+	if _, err := dst.Seek(pos, io.SeekStart); err != nil {
+		return err
+	}
+	e.animationChunks = next
+	for i := 0; i < len(newFrames) && e.err == nil; i++ {
+		f, err := os.Open(newFrames[i])
+		if err != nil {
+			return fmt.Errorf("could not open frame %s: %v", newFrames[i], err)
 		}
+		e.writeFDAT(f, newFrames[i], frameControl{
+			delayNum: fractions[i].Num,
+			delayDen: fractions[i].Den,
+		})
+		f.Close()
 	}
+	e.writeIEND()
+	e.rewriteACTL(loop)
+	return e.err
+}
 
-	// Find all png files
-	list, err := ioutil.ReadDir(dirname)
+// Decode reads an APNG from r and returns every frame composited onto the
+// canvas as it is displayed, honoring the dispose and blend operations.
+// The delays are in milliseconds and loop is the acTL loop count, 0 is infinite.
+// The frames are *image.NRGBA, or *image.NRGBA64 for 16 bit images, so that
+// translucent colors are kept exactly.
+// A PNG without acTL is returned as a single frame.
+// A default image that is not part of the animation is skipped.
+// A canvas of more than 16384 x 16384 pixels is a FormatError.
+// An acTL whose number of frames is 0 or not the number of fcTL chunks is a FormatError.
+func Decode(r io.Reader) (frames []image.Image, delays []int, loop int, err error) {
+	frames, fractions, loop, err := decode(r)
 	if err != nil {
-		log.Fatalf("ReadDir: Could not read %s", dirname)
+		return nil, nil, 0, err
+	}
+	delays = make([]int, len(fractions))
+	for i, d := range fractions {
+		den := int(d.Den)
+		if den == 0 {
+			den = 100
+		}
+		delays[i] = (int(d.Num)*1000 + den/2) / den
+	}
+	return frames, delays, loop, nil
+}
+
+// decode is Decode with the delays as they are in fcTL.
+func decode(r io.Reader) (frames []image.Image, delays []Delay, loop int, err error) {
+	d := &decoder{
+		r:   bufio.NewReader(r),
+		crc: crc32.NewIEEE(),
+	}
+	if err := d.checkHeader(); err != nil {
+		return nil, nil, 0, err
+	}
+
+	var ihdr []byte  // IHDR data of the canvas
+	var extra []byte // PLTE and tRNS chunks needed to decode the frames
+	var fctls []frameControl
+	var data [][]byte // compressed image data of each frame
+	animated := false
+	numFrames := 0 // acTL num_frames
+	for first := true; ; first = false {
+		length, err := d.parseChunk()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, nil, 0, err
+		}
+		chunk := d.tmp[8 : length-4]
+		if first != (d.ChunkName == "IHDR") {
+			return nil, nil, 0, FormatError("IHDR must be the first chunk")
+		}
+		switch d.ChunkName {
+		case "IHDR":
+			if len(chunk) != 13 {
+				return nil, nil, 0, FormatError("bad IHDR length")
+			}
+			if err := checkCanvasSize(chunk); err != nil {
+				return nil, nil, 0, err
+			}
+			ihdr = append([]byte(nil), chunk...)
+		case "PLTE", "tRNS":
+			extra = append(extra, d.tmp[:length]...)
+		case "acTL":
+			if len(chunk) != 8 {
+				return nil, nil, 0, FormatError("bad acTL length")
+			}
+			animated = true
+			numFrames = int(binary.BigEndian.Uint32(chunk[0:4]))
+			if numFrames == 0 {
+				return nil, nil, 0, FormatError("acTL num_frames is 0")
+			}
+			loop = int(binary.BigEndian.Uint32(chunk[4:8]))
+		case "fcTL":
+			if len(chunk) != 26 {
+				return nil, nil, 0, FormatError("bad fcTL length")
+			}
+			fc := frameControl{
+				width:     int(binary.BigEndian.Uint32(chunk[4:8])),
+				height:    int(binary.BigEndian.Uint32(chunk[8:12])),
+				xOffset:   int(binary.BigEndian.Uint32(chunk[12:16])),
+				yOffset:   int(binary.BigEndian.Uint32(chunk[16:20])),
+				delayNum:  binary.BigEndian.Uint16(chunk[20:22]),
+				delayDen:  binary.BigEndian.Uint16(chunk[22:24]),
+				disposeOp: DisposeOp(chunk[24]),
+				blendOp:   BlendOp(chunk[25]),
+			}
+			canvasWidth := int(binary.BigEndian.Uint32(ihdr[0:4]))
+			canvasHeight := int(binary.BigEndian.Uint32(ihdr[4:8]))
+			if fc.width <= 0 || fc.height <= 0 || fc.xOffset < 0 || fc.yOffset < 0 ||
+				fc.xOffset+fc.width > canvasWidth || fc.yOffset+fc.height > canvasHeight {
+				return nil, nil, 0, FormatError("fcTL frame region outside of the canvas")
+			}
+			fctls = append(fctls, fc)
+			data = append(data, nil)
+		case "IDAT":
+			if !animated {
+				// Plain PNG, the default image is the only frame
+				if len(fctls) == 0 {
+					fctls = append(fctls, frameControl{
+						width:  int(binary.BigEndian.Uint32(ihdr[0:4])),
+						height: int(binary.BigEndian.Uint32(ihdr[4:8])),
+					})
+					data = append(data, nil)
+				}
+				data[0] = append(data[0], chunk...)
+			} else if len(fctls) == 1 {
+				// The default image is the first frame if a fcTL precedes it
+				data[0] = append(data[0], chunk...)
+			}
+		case "fdAT":
+			if len(fctls) == 0 || len(chunk) < 4 {
+				return nil, nil, 0, FormatError("fdAT without fcTL")
+			}
+			// Strip the sequence number, the data of all fdAT chunks of a frame form one zlib stream
+			data[len(data)-1] = append(data[len(data)-1], chunk[4:]...)
+		}
+		if d.ChunkName == "IEND" {
+			break
+		}
+	}
+	if len(fctls) == 0 {
+		return nil, nil, 0, FormatError("no frames")
+	}
+	if animated && len(fctls) != numFrames {
+		return nil, nil, 0, FormatError(fmt.Sprintf("acTL num_frames is %d but there are %d fcTL chunks", numFrames, len(fctls)))
+	}
+
+	// The canvas is not premultiplied, so that translucent pixels keep their
+	// colors, and has 16 bit samples for 16 bit images
+	canvas := image.NewNRGBA64(image.Rect(0, 0, int(binary.BigEndian.Uint32(ihdr[0:4])), int(binary.BigEndian.Uint32(ihdr[4:8]))))
+	var previous []uint8 // the canvas before a frame with DisposeOpPrevious
+	for i, fc := range fctls {
+		img, err := decodeFrame(ihdr, extra, fc, data[i])
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("frame %d: %v", i, err)
+		}
+		region := image.Rect(fc.xOffset, fc.yOffset, fc.xOffset+fc.width, fc.yOffset+fc.height)
+
+		disposeOp := fc.disposeOp
+		if disposeOp == DisposeOpPrevious && i == 0 {
+			// APNG_DISPOSE_OP_PREVIOUS on the first frame is treated as APNG_DISPOSE_OP_BACKGROUND
+			disposeOp = DisposeOpBackground
+		}
+		if disposeOp == DisposeOpPrevious {
+			previous = append(previous[:0], canvas.Pix...)
+		}
+
+		b := img.Bounds()
+		for y := 0; y < fc.height; y++ {
+			for x := 0; x < fc.width; x++ {
+				c := nrgba64(img.At(b.Min.X+x, b.Min.Y+y))
+				if fc.blendOp == BlendOpOver {
+					c = over(canvas.NRGBA64At(region.Min.X+x, region.Min.Y+y), c)
+				}
+				canvas.SetNRGBA64(region.Min.X+x, region.Min.Y+y, c)
+			}
+		}
+		frames = append(frames, canvasFrame(canvas, ihdr[8] == 16))
+
+		delays = append(delays, Delay{fc.delayNum, fc.delayDen})
+
+		switch disposeOp {
+		case DisposeOpBackground:
+			for y := region.Min.Y; y < region.Max.Y; y++ {
+				row := canvas.Pix[canvas.PixOffset(region.Min.X, y):canvas.PixOffset(region.Max.X, y)]
+				for j := range row {
+					row[j] = 0
+				}
+			}
+		case DisposeOpPrevious:
+			copy(canvas.Pix, previous)
+		}
+	}
+	return frames, delays, loop, nil
+}
+
+// maxDecodePixels is the largest canvas Decode allocates, 16384 x 16384 pixels.
+const maxDecodePixels = 1 << 28
+
+// checkCanvasSize returns a FormatError if the canvas of the IHDR data ihdr
+// is empty or too large for Decode to allocate.
+func checkCanvasSize(ihdr []byte) error {
+	w, h := binary.BigEndian.Uint32(ihdr[0:4]), binary.BigEndian.Uint32(ihdr[4:8])
+	if w == 0 || h == 0 || w > 0x7fffffff || h > 0x7fffffff {
+		return FormatError(fmt.Sprintf("invalid image size %d x %d", w, h))
+	}
+	// The canvas has 8 bytes per pixel
+	if n := uint64(w) * uint64(h); n > maxDecodePixels || 8*n > uint64(^uint(0)>>1) {
+		return FormatError(fmt.Sprintf("image size %d x %d is too large, at most %d pixels are decoded", w, h, maxDecodePixels))
+	}
+	return nil
+}
+
+// nrgba64 converts c to color.NRGBA64 without premultiplying it, which
+// color.NRGBA64Model does and which changes the colors of translucent pixels.
+func nrgba64(c color.Color) color.NRGBA64 {
+	switch c := c.(type) {
+	case color.NRGBA:
+		return color.NRGBA64{uint16(c.R) * 0x101, uint16(c.G) * 0x101, uint16(c.B) * 0x101, uint16(c.A) * 0x101}
+	case color.NRGBA64:
+		return c
+	}
+	return color.NRGBA64Model.Convert(c).(color.NRGBA64)
+}
+
+// over returns src alpha composited over dst, the way the APNG spec does it
+// for APNG_BLEND_OP_OVER on colors that are not premultiplied.
+func over(dst, src color.NRGBA64) color.NRGBA64 {
+	switch src.A {
+	case 0xffff:
+		return src
+	case 0:
+		return dst
 	}
-	pngfiles := make([]string, 0)
-	delays := make([]int, 0)
-	delays = append(delays, readdelays...)
+	sa := uint64(src.A)
+	da := uint64(dst.A) * (0xffff - sa) / 0xffff
+	a := sa + da
+	blend := func(s, d uint16) uint16 {
+		return uint16((uint64(s)*sa + uint64(d)*da + a/2) / a)
+	}
+	return color.NRGBA64{blend(src.R, dst.R), blend(src.G, dst.G), blend(src.B, dst.B), uint16(a)}
+}
+
+// canvasFrame returns a copy of the canvas, an *image.NRGBA for images with
+// 8 bit samples or less and an *image.NRGBA64 for 16 bit images.
+func canvasFrame(canvas *image.NRGBA64, sixteen bool) image.Image {
+	if sixteen {
+		frame := image.NewNRGBA64(canvas.Rect)
+		copy(frame.Pix, canvas.Pix)
+		return frame
+	}
+	// The high byte of each sample, the 8 bit samples were extended by repeating them
+	frame := image.NewNRGBA(canvas.Rect)
+	for i := range frame.Pix {
+		frame.Pix[i] = canvas.Pix[2*i]
+	}
+	return frame
+}
+
+// setNRGBA64 sets the pixel x, y of m, a frame returned by decode, to c.
+func setNRGBA64(m image.Image, x, y int, c color.NRGBA64) {
+	switch m := m.(type) {
+	case *image.NRGBA:
+		m.SetNRGBA(x, y, color.NRGBA{uint8(c.R >> 8), uint8(c.G >> 8), uint8(c.B >> 8), uint8(c.A >> 8)})
+	case *image.NRGBA64:
+		m.SetNRGBA64(x, y, c)
+	}
+}
 
-	for _, value := range list {
-		if strings.HasSuffix(value.Name(), ".png") {
-			pngfiles = append(pngfiles, dirname+"/"+value.Name())
-			if len(delays) < len(pngfiles) {
-				delays = append(delays, globaldelay/10)
+// drawOver composites src over dst, a frame returned by decode, with the
+// top left corner of src at p. The parts of src outside of dst are left out.
+func drawOver(dst, src image.Image, p image.Point) {
+	b := src.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			q := p.Add(image.Pt(x, y).Sub(b.Min))
+			if q.In(dst.Bounds()) {
+				setNRGBA64(dst, q.X, q.Y, over(nrgba64(dst.At(q.X, q.Y)), nrgba64(src.At(x, y))))
 			}
 		}
 	}
+}
+
+// Watermark reads the APNG from r, draws overlay with its alpha onto every
+// frame with its top left corner at x, y of the canvas and writes the result
+// to w with the delays and loop count of r. The frames are composited the way
+// Decode does it, so every frame is re-encoded as the whole canvas without
+// dispose and blend ops, and a default image that is not part of the
+// animation is left out.
+func Watermark(r io.Reader, overlay image.Image, x, y int, w io.Writer) error {
+	frames, delays, loop, err := decode(r)
+	if err != nil {
+		return err
+	}
+	for _, frame := range frames {
+		drawOver(frame, overlay, image.Pt(x, y))
+	}
+	return encodeImages(w, frames, delays, &EncodeOptions{Loop: loop})
+}
 
-	// Open output file
-	w, err := os.Create(output)
+// OnionSkin reads the APNG from r and writes it to w with the earlier frames
+// as a fading trail behind every frame, for reviewing motion. Every frame is
+// composited the way Decode does it and drawn over the output frame before it,
+// whose alpha is multiplied by 1-fade first. A fade of 1 shows every frame
+// alone, 0 keeps all earlier frames. The output frames are the whole canvas
+// and the delays and loop count of r are kept. A fade outside of 0 to 1 is a
+// FormatError.
+func OnionSkin(r io.Reader, w io.Writer, fade float64) error {
+	if !(fade >= 0 && fade <= 1) {
+		return FormatError(fmt.Sprintf("fade %v is not between 0 and 1", fade))
+	}
+	frames, delays, loop, err := decode(r)
 	if err != nil {
-		log.Fatalf("Could not open output file: %s", output)
+		return err
+	}
+	trail := image.NewNRGBA64(frames[0].Bounds())
+	for i, frame := range frames {
+		// The alpha is the last of the four 16 bit samples of a pixel
+		for j := 6; j < len(trail.Pix); j += 8 {
+			a := uint16(float64(uint16(trail.Pix[j])<<8|uint16(trail.Pix[j+1]))*(1-fade) + 0.5)
+			trail.Pix[j], trail.Pix[j+1] = uint8(a>>8), uint8(a)
+		}
+		drawOver(trail, frame, image.ZP)
+		_, sixteen := frame.(*image.NRGBA64)
+		frames[i] = canvasFrame(trail, sixteen)
+	}
+	return encodeImages(w, frames, delays, &EncodeOptions{Loop: loop})
+}
+
+// decodeFrame decodes the compressed image data of a frame by wrapping it
+// into a PNG file with the dimensions of the frame and decoding that with image/png.
+func decodeFrame(ihdr []byte, extra []byte, fc frameControl, data []byte) (image.Image, error) {
+	var b bytes.Buffer
+	e := &encoder{
+		w: &b,
+	}
+	b.WriteString(pngHeader)
+	frameIHDR := append([]byte(nil), ihdr...)
+	writeUint32(frameIHDR[0:4], uint32(fc.width))
+	writeUint32(frameIHDR[4:8], uint32(fc.height))
+	e.writeChunk(frameIHDR, "IHDR")
+	b.Write(extra)
+	e.writeChunk(data, "IDAT")
+	e.writeIEND()
+	if e.err != nil {
+		return nil, e.err
+	}
+	return png.Decode(&b)
+}
+
+// Info describes a PNG or APNG file.
+type Info struct {
+	Width, Height   int
+	BitDepth        int
+	ColorType       int
+	HasAlpha        bool          // whether the color type has an alpha channel
+	Transparent     bool          // whether the image has an alpha channel or a tRNS chunk
+	Animated        bool          // whether the file has an acTL chunk
+	Frames          int           // number of frames from the acTL chunk
+	Loop            int           // number of times to loop, 0 is infinite
+	Duration        time.Duration // total of all frame delays
+	AnimationChunks int           // number of fcTL and fdAT chunks
+}
+
+// DecodeInfo reads the metadata of a PNG or APNG file without decompressing any image data.
+func DecodeInfo(r io.Reader) (Info, error) {
+	var info Info
+	d := &decoder{
+		r:   bufio.NewReader(r),
+		crc: crc32.NewIEEE(),
+	}
+	if err := d.checkHeader(); err != nil {
+		return info, err
+	}
+	for first := true; ; first = false {
+		length, err := d.parseChunk()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return info, err
+		}
+		data := d.tmp[8 : length-4]
+		if first != (d.ChunkName == "IHDR") {
+			return info, FormatError("IHDR must be the first chunk")
+		}
+		switch d.ChunkName {
+		case "IHDR":
+			if len(data) != 13 {
+				return info, FormatError("bad IHDR length")
+			}
+			info.Width = int(binary.BigEndian.Uint32(data[0:4]))
+			info.Height = int(binary.BigEndian.Uint32(data[4:8]))
+			info.BitDepth = int(data[8])
+			info.ColorType = int(data[9])
+			info.HasAlpha = data[9]&4 != 0
+			info.Transparent = info.HasAlpha
+		case "tRNS":
+			info.Transparent = true
+		case "acTL":
+			if len(data) != 8 {
+				return info, FormatError("bad acTL length")
+			}
+			info.Animated = true
+			info.Frames = int(binary.BigEndian.Uint32(data[0:4]))
+			info.Loop = int(binary.BigEndian.Uint32(data[4:8]))
+		case "fcTL":
+			if len(data) != 26 {
+				return info, FormatError("bad fcTL length")
+			}
+			num := time.Duration(binary.BigEndian.Uint16(data[20:22]))
+			den := time.Duration(binary.BigEndian.Uint16(data[22:24]))
+			if den == 0 {
+				den = 100
+			}
+			info.Duration += num * time.Second / den
+			info.AnimationChunks++
+		case "fdAT":
+			info.AnimationChunks++
+		case "IEND":
+			return info, nil
+		}
+	}
+}
+
+// Validate checks the chunk order of the PNG or APNG file in r: IHDR first,
+// at most one acTL before the first IDAT, fcTL and fdAT chunks, the sequence
+// numbers of fcTL and fdAT starting at 0 without gaps, as many fcTL chunks as
+// num_frames in acTL and IEND last. The first violation is returned as a
+// FormatError, the crc of every chunk is checked as well.
+func Validate(r io.Reader) error {
+	return ValidateWithOptions(r, nil)
+}
+
+// DecodeOptions are the options of ValidateWithOptions, nil is the same as
+// the zero value.
+type DecodeOptions struct {
+	// CheckDataLength, if true, decompresses the IDAT or fdAT data of every
+	// frame and checks that it is as long as the filtered rows of the frame
+	// size, bit depth, color type and interlace method. Truncated or corrupt
+	// data can have a valid crc. Decode always fails on such frames.
+	CheckDataLength bool
+}
+
+// ValidateWithOptions is like Validate with the checks of o.
+func ValidateWithOptions(r io.Reader, o *DecodeOptions) error {
+	if o == nil {
+		o = &DecodeOptions{}
+	}
+	d := &decoder{
+		r:   bufio.NewReader(r),
+		crc: crc32.NewIEEE(),
+	}
+	if err := d.checkHeader(); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return FormatError("not a PNG file")
+		}
+		return err
+	}
+	var seq uint32  // next sequence number
+	numFrames := -1 // num_frames of acTL, -1 without acTL
+	fctl := 0       // number of fcTL chunks
+	idat := false   // whether an IDAT chunk was read
+
+	// With CheckDataLength the compressed data of the frame that is read
+	// is collected and checked when the next frame or IEND starts
+	var ihdr []byte
+	var zdata bytes.Buffer
+	var frameWidth, frameHeight int
+	frameName := "" // empty if no frame is collected
+	checkFrame := func() error {
+		if !o.CheckDataLength || frameName == "" {
+			return nil
+		}
+		name := frameName
+		frameName = ""
+		want := rawDataLength(frameWidth, frameHeight, ihdr)
+		if want < 0 {
+			// Unknown color type or bit depth
+			return nil
+		}
+		if zdata.Len() == 0 {
+			return FormatError(name + " has no image data")
+		}
+		zr, err := zlib.NewReader(&zdata)
+		if err != nil {
+			return FormatError(fmt.Sprintf("%s has corrupt image data: %v", name, err))
+		}
+		n, err := io.CopyN(ioutil.Discard, zr, want+1)
+		if err != nil && err != io.EOF {
+			return FormatError(fmt.Sprintf("%s has corrupt image data: %v", name, err))
+		}
+		if n > want {
+			return FormatError(fmt.Sprintf("%s has more than %d bytes of image data, expected %d", name, want, want))
+		}
+		if n < want {
+			return FormatError(fmt.Sprintf("%s has %d bytes of image data, expected %d", name, n, want))
+		}
+		return nil
+	}
+	imageData := ioutil.Discard
+	if o.CheckDataLength {
+		imageData = &zdata
+	}
+
+	for first := true; ; first = false {
+		length, err := d.readChunkHeader()
+		if err == io.EOF {
+			return FormatError("no IEND chunk")
+		}
+		if err != nil {
+			return err
+		}
+		if first != (d.ChunkName == "IHDR") {
+			if first {
+				return FormatError(d.ChunkName + " chunk before IHDR, IHDR must be the first chunk")
+			}
+			return FormatError("second IHDR chunk")
+		}
+		switch d.ChunkName {
+		case "acTL", "fcTL", "fdAT":
+			if d.ChunkName == "acTL" && numFrames != -1 {
+				return FormatError("second acTL chunk")
+			}
+			if d.ChunkName == "acTL" && (idat || seq > 0) {
+				return FormatError("acTL chunk after the image data, it must be before the first IDAT, fcTL and fdAT")
+			}
+			if d.ChunkName != "acTL" && numFrames == -1 {
+				return FormatError(d.ChunkName + " chunk without a preceding acTL chunk")
+			}
+			if d.ChunkName == "fdAT" && fctl == 0 {
+				return FormatError("fdAT chunk before the first fcTL chunk")
+			}
+		}
+		switch d.ChunkName {
+		case "fdAT":
+			// Only the sequence number is needed, the image data is skipped
+			if length < 12+4 {
+				return FormatError("bad fdAT length")
+			}
+			var b []byte
+			if b, err = d.appendChunkData(nil, 4); err == nil {
+				err = d.copyChunkData(imageData, length-4)
+			}
+			if err != nil {
+				return err
+			}
+			if n := binary.BigEndian.Uint32(b); n != seq {
+				return FormatError(fmt.Sprintf("fdAT chunk has sequence number %d, expected %d", n, seq))
+			}
+			seq++
+		case "IDAT":
+			if fctl == 0 && !idat {
+				// The default image is not part of the animation
+				frameName = "the default image"
+				frameWidth = int(binary.BigEndian.Uint32(ihdr[0:4]))
+				frameHeight = int(binary.BigEndian.Uint32(ihdr[4:8]))
+				zdata.Reset()
+			}
+			idat = true
+			if err := d.copyChunkData(imageData, length); err != nil {
+				return err
+			}
+		default:
+			if err := d.readChunkBody(length); err != nil {
+				return err
+			}
+		}
+		if d.ChunkName == "IDAT" || d.ChunkName == "fdAT" {
+			continue
+		}
+		data := d.tmp[8 : length-4]
+		switch d.ChunkName {
+		case "IHDR":
+			if len(data) != 13 {
+				return FormatError("bad IHDR length")
+			}
+			ihdr = append([]byte(nil), data...)
+		case "acTL":
+			if len(data) != 8 {
+				return FormatError("bad acTL length")
+			}
+			numFrames = int(binary.BigEndian.Uint32(data[0:4]))
+			if numFrames == 0 {
+				return FormatError("acTL num_frames is 0")
+			}
+		case "fcTL":
+			if len(data) != 26 {
+				return FormatError("bad fcTL length")
+			}
+			if n := binary.BigEndian.Uint32(data[0:4]); n != seq {
+				return FormatError(fmt.Sprintf("fcTL chunk has sequence number %d, expected %d", n, seq))
+			}
+			if err := checkFrame(); err != nil {
+				return err
+			}
+			frameName = fmt.Sprintf("frame %d", fctl)
+			frameWidth = int(binary.BigEndian.Uint32(data[4:8]))
+			frameHeight = int(binary.BigEndian.Uint32(data[8:12]))
+			zdata.Reset()
+			seq++
+			fctl++
+		case "IEND":
+			if !idat {
+				return FormatError("no IDAT chunk")
+			}
+			if err := checkFrame(); err != nil {
+				return err
+			}
+			if numFrames != -1 && fctl != numFrames {
+				return FormatError(fmt.Sprintf("acTL num_frames is %d but there are %d fcTL chunks", numFrames, fctl))
+			}
+			if _, err := d.r.Peek(1); err == nil {
+				return FormatError("data after IEND, IEND must be the last chunk")
+			}
+			return nil
+		}
 	}
-	defer w.Close()
+}
 
-	Encode(w, pngfiles, delays)
+// rawDataLength returns the size of the filtered rows of a w x h image with
+// the bit depth, color type and interlace method of the IHDR data ihdr, or -1
+// for an unknown color type or bit depth.
+func rawDataLength(w, h int, ihdr []byte) int64 {
+	channels := map[uint8]int64{0: 1, 2: 3, 3: 1, 4: 2, 6: 4}[ihdr[9]]
+	bitDepth := int64(ihdr[8])
+	if channels == 0 || bitDepth == 0 || 16%bitDepth != 0 {
+		return -1
+	}
+	rows := func(w, h int64) int64 {
+		if w <= 0 || h <= 0 {
+			// An empty pass has no filter bytes
+			return 0
+		}
+		return h * (1 + (w*channels*bitDepth+7)/8)
+	}
+	if ihdr[12] == 0 {
+		return rows(int64(w), int64(h))
+	}
+	// The seven passes of Adam7 as x, y, dx, dy
+	var n int64
+	for _, p := range [7][4]int64{{0, 0, 8, 8}, {4, 0, 8, 8}, {0, 4, 4, 8}, {2, 0, 4, 4}, {0, 2, 2, 4}, {1, 0, 2, 2}, {0, 1, 1, 2}} {
+		n += rows((int64(w)-p[0]+p[2]-1)/p[2], (int64(h)-p[1]+p[3]-1)/p[3])
+	}
+	return n
+}
 
-	fmt.Printf("End\n")
+// EvenTimeBase returns the TimeBase and SnapTimeBase options that split the
+// duration total evenly across frames delays of 1. The exact fraction is used
+// if it fits into fcTL, otherwise the delays are rounded to the finest of
+// 1/1000, 1/100, 1/10 or 1 second that fits.
+func EvenTimeBase(total time.Duration, frames int) (Rational, uint16, error) {
+	ms := total / time.Millisecond
+	if ms < 1 {
+		return Rational{}, 0, FormatError("duration must be at least 1ms")
+	}
+	if frames < 1 {
+		return Rational{}, 0, FormatError("no frames, an animation needs at least one frame")
+	}
+	if ms > 0xffffffff || 1000*uint64(frames) > 0xffffffff {
+		return Rational{}, 0, UnsupportedError("duration or number of frames too large")
+	}
+	num, den := uint64(ms), 1000*uint64(frames)
+	g := gcd(num, den)
+	tb := Rational{uint32(num / g), uint32(den / g)}
+	if tb.Num <= 0xffff && tb.Den <= 0xffff {
+		return tb, 0, nil
+	}
+	for _, snap := range []uint64{1000, 100, 10, 1} {
+		// Longest delay of a single frame after rounding to 1/snap seconds
+		if (num*snap+den-1)/den <= 0xffff {
+			return tb, uint16(snap), nil
+		}
+	}
+	return Rational{}, 0, UnsupportedError("a single frame would be longer than 65535 seconds")
 }
@@ -0,0 +1,1599 @@
+package apng
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testImage returns a w x h image whose pixels depend on seed.
+func testImage(w, h int, seed uint8) *image.NRGBA {
+	m := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			m.SetNRGBA(x, y, color.NRGBA{uint8(x*16) + seed, uint8(y*16) + seed, seed, 255})
+		}
+	}
+	return m
+}
+
+// writePNGs encodes imgs with image/png into files in a temporary directory
+// and returns their names.
+func writePNGs(t testing.TB, imgs ...image.Image) []string {
+	dir := t.TempDir()
+	names := make([]string, len(imgs))
+	for i, img := range imgs {
+		var b bytes.Buffer
+		if err := png.Encode(&b, img); err != nil {
+			t.Fatal(err)
+		}
+		names[i] = filepath.Join(dir, strconv.Itoa(i)+".png")
+		if err := ioutil.WriteFile(names[i], b.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return names
+}
+
+type chunk struct {
+	name string
+	data []byte
+}
+
+// readChunks returns the chunks of the png file b.
+func readChunks(t testing.TB, b []byte) []chunk {
+	if len(b) < len(pngHeader) || string(b[:len(pngHeader)]) != pngHeader {
+		t.Fatal("no PNG header")
+	}
+	var chunks []chunk
+	for b = b[len(pngHeader):]; len(b) > 0; {
+		if len(b) < 12 {
+			t.Fatalf("truncated chunk of %d bytes", len(b))
+		}
+		n := int(binary.BigEndian.Uint32(b[:4]))
+		chunks = append(chunks, chunk{string(b[4:8]), b[8 : 8+n]})
+		b = b[12+n:]
+	}
+	return chunks
+}
+
+// buildPNG returns a png file of the chunks with their crc.
+func buildPNG(chunks []chunk) []byte {
+	b := []byte(pngHeader)
+	for _, c := range chunks {
+		var n [4]byte
+		binary.BigEndian.PutUint32(n[:], uint32(len(c.data)))
+		b = append(b, n[:]...)
+		start := len(b)
+		b = append(append(b, c.name...), c.data...)
+		binary.BigEndian.PutUint32(n[:], crc32.ChecksumIEEE(b[start:]))
+		b = append(b, n[:]...)
+	}
+	return b
+}
+
+// sameImage reports whether a and b have the same size and the same colors.
+func sameImage(a, b image.Image) bool {
+	ab, bb := a.Bounds(), b.Bounds()
+	if ab.Size() != bb.Size() {
+		return false
+	}
+	for y := 0; y < ab.Dy(); y++ {
+		for x := 0; x < ab.Dx(); x++ {
+			ca := color.NRGBAModel.Convert(a.At(ab.Min.X+x, ab.Min.Y+y))
+			cb := color.NRGBAModel.Convert(b.At(bb.Min.X+x, bb.Min.Y+y))
+			if ca != cb {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestEncodeIsPNG(t *testing.T) {
+	frames := []image.Image{testImage(16, 8, 0), testImage(16, 8, 100), testImage(16, 8, 200)}
+	var b bytes.Buffer
+	if err := Encode(&b, writePNGs(t, frames...), []int{10, 10, 10}); err != nil {
+		t.Fatal(err)
+	}
+	if c := readChunks(t, b.Bytes()); c[1].name != "acTL" {
+		t.Fatalf("chunk after IHDR is %s, not acTL", c[1].name)
+	}
+	// A decoder without APNG support shows the default image, the first frame
+	img, err := png.Decode(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameImage(img, frames[0]) {
+		t.Error("png.Decode does not return the first frame")
+	}
+}
+
+func TestEncodeNoFrames(t *testing.T) {
+	var b bytes.Buffer
+	if err := Encode(&b, nil, nil); err == nil {
+		t.Error("Encode without frames did not fail")
+	} else if _, ok := err.(FormatError); !ok {
+		t.Errorf("Encode without frames: %v is not a FormatError", err)
+	}
+	if err := EncodeImages(&b, nil, nil); err == nil {
+		t.Error("EncodeImages without frames did not fail")
+	}
+	if b.Len() != 0 {
+		t.Errorf("%d bytes were written without frames", b.Len())
+	}
+}
+
+func TestDecodeZeroFrames(t *testing.T) {
+	var b bytes.Buffer
+	if err := Encode(&b, writePNGs(t, testImage(4, 4, 0), testImage(4, 4, 1)), []int{1, 1}); err != nil {
+		t.Fatal(err)
+	}
+	chunks := readChunks(t, b.Bytes())
+	for i, c := range chunks {
+		if c.name == "acTL" {
+			data := append([]byte(nil), c.data...)
+			binary.BigEndian.PutUint32(data[0:4], 0)
+			chunks[i].data = data
+		}
+	}
+	crafted := buildPNG(chunks)
+	if _, _, _, err := Decode(bytes.NewReader(crafted)); err == nil {
+		t.Error("Decode accepted acTL num_frames 0")
+	} else if _, ok := err.(FormatError); !ok {
+		t.Errorf("Decode: %v is not a FormatError", err)
+	}
+	if err := Validate(bytes.NewReader(crafted)); err == nil {
+		t.Error("Validate accepted acTL num_frames 0")
+	}
+}
+
+func TestTimeBase(t *testing.T) {
+	tests := []struct {
+		fps      string
+		timeBase Rational
+		one, two Delay // fcTL delay of 1 and 2 video frames
+	}{
+		{"23.976", Rational{1001, 24000}, Delay{1001, 24000}, Delay{1001, 12000}},
+		{"25", Rational{1, 25}, Delay{1, 25}, Delay{2, 25}},
+		{"29.97", Rational{1001, 30000}, Delay{1001, 30000}, Delay{1001, 15000}},
+		{"30", Rational{1, 30}, Delay{1, 30}, Delay{1, 15}},
+	}
+	for _, test := range tests {
+		fractions, err := fractionDelays([]int{1, 2}, &EncodeOptions{TimeBase: test.timeBase})
+		if err != nil {
+			t.Errorf("%s fps: %v", test.fps, err)
+			continue
+		}
+		if fractions[0] != test.one || fractions[1] != test.two {
+			t.Errorf("%s fps: got %v, want %v", test.fps, fractions, []Delay{test.one, test.two})
+		}
+
+		// Snapped to 1/30 seconds every frame starts at most 1/60 seconds off
+		const snap = 30
+		delays := make([]int, 1000)
+		for i := range delays {
+			delays[i] = 1
+		}
+		fractions, err = fractionDelays(delays, &EncodeOptions{TimeBase: test.timeBase, SnapTimeBase: snap})
+		if err != nil {
+			t.Errorf("%s fps snapped: %v", test.fps, err)
+			continue
+		}
+		var elapsed int64 // in 1/snap seconds
+		for i, f := range fractions {
+			if f.Den != snap {
+				t.Errorf("%s fps snapped: frame %d has the delay %v", test.fps, i, f)
+				break
+			}
+			elapsed += int64(f.Num)
+			// |elapsed/snap - (i+1)*Num/Den| <= 1/(2*snap)
+			diff := elapsed*int64(test.timeBase.Den) - int64(i+1)*int64(test.timeBase.Num)*snap
+			if diff < 0 {
+				diff = -diff
+			}
+			if 2*diff > int64(test.timeBase.Den) {
+				t.Errorf("%s fps snapped: frame %d ends %d/%d seconds off", test.fps, i, diff, snap*int64(test.timeBase.Den))
+				break
+			}
+		}
+	}
+
+	// The fraction ends up in fcTL
+	var b bytes.Buffer
+	o := &EncodeOptions{TimeBase: Rational{1001, 24000}}
+	if err := EncodeWithOptions(&b, writePNGs(t, testImage(4, 4, 0), testImage(4, 4, 1)), []int{1, 2}, o); err != nil {
+		t.Fatal(err)
+	}
+	var got []Delay
+	for _, c := range readChunks(t, b.Bytes()) {
+		if c.name == "fcTL" {
+			got = append(got, Delay{binary.BigEndian.Uint16(c.data[20:22]), binary.BigEndian.Uint16(c.data[22:24])})
+		}
+	}
+	if len(got) != 2 || got[0] != (Delay{1001, 24000}) || got[1] != (Delay{1001, 12000}) {
+		t.Errorf("fcTL delays are %v", got)
+	}
+}
+
+// errWriter fails every write.
+type errWriter struct{}
+
+func (errWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestEncoderCloseFlushError(t *testing.T) {
+	// The frames fit into the buffer, only the flush in Close reaches errWriter
+	w := bufio.NewWriterSize(errWriter{}, 1<<16)
+	enc := NewEncoder(w, 4, 4, 0)
+	enc.Frames = 2
+	for i := 0; i < 2; i++ {
+		if err := enc.AddFrame(testImage(4, 4, uint8(i)), 10); err != nil {
+			t.Fatalf("AddFrame: %v", err)
+		}
+	}
+	if err := enc.Close(); err == nil {
+		t.Error("Close did not return the error of the flush")
+	}
+}
+
+// frameData returns the image data of every frame of the APNG chunks, the
+// IDAT data of the default image if it is a frame and the fdAT data without
+// the sequence numbers.
+func frameData(chunks []chunk) [][]byte {
+	var frames [][]byte
+	for _, c := range chunks {
+		switch c.name {
+		case "fcTL":
+			frames = append(frames, nil)
+		case "IDAT":
+			if len(frames) == 1 {
+				frames[0] = append(frames[0], c.data...)
+			}
+		case "fdAT":
+			frames[len(frames)-1] = append(frames[len(frames)-1], c.data[4:]...)
+		}
+	}
+	return frames
+}
+
+func TestTinyLastIDAT(t *testing.T) {
+	for tail := 1; tail <= 4; tail++ {
+		// Split the image data of every frame so that the last IDAT has tail bytes
+		dir := t.TempDir()
+		var names []string
+		var want [][]byte
+		for i := 0; i < 3; i++ {
+			var b bytes.Buffer
+			if err := png.Encode(&b, testImage(8, 8, uint8(i))); err != nil {
+				t.Fatal(err)
+			}
+			var chunks []chunk
+			for _, c := range readChunks(t, b.Bytes()) {
+				if c.name == "IDAT" {
+					want = append(want, c.data)
+					n := len(c.data) - tail
+					chunks = append(chunks, chunk{"IDAT", c.data[:n]}, chunk{"IDAT", c.data[n:]})
+					continue
+				}
+				chunks = append(chunks, c)
+			}
+			name := filepath.Join(dir, strconv.Itoa(i)+".png")
+			if err := ioutil.WriteFile(name, buildPNG(chunks), 0644); err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, name)
+		}
+		for _, chunkSize := range []int{0, minChunkSize} {
+			var b bytes.Buffer
+			if err := EncodeWithOptions(&b, names, []int{1, 1, 1}, &EncodeOptions{ChunkSize: chunkSize}); err != nil {
+				t.Fatal(err)
+			}
+			got := frameData(readChunks(t, b.Bytes()))
+			if len(got) != len(want) {
+				t.Fatalf("tail %d, chunk size %d: %d frames, want %d", tail, chunkSize, len(got), len(want))
+			}
+			for i := range want {
+				if !bytes.Equal(got[i], want[i]) {
+					t.Errorf("tail %d, chunk size %d: frame %d has %d bytes of image data, want %d", tail, chunkSize, i, len(got[i]), len(want[i]))
+				}
+			}
+		}
+	}
+}
+
+// numFrames returns acTL num_frames and the number of fcTL chunks.
+func numFrames(t testing.TB, b []byte) (int, int) {
+	actl, fctl := -1, 0
+	for _, c := range readChunks(t, b) {
+		switch c.name {
+		case "acTL":
+			actl = int(binary.BigEndian.Uint32(c.data[0:4]))
+		case "fcTL":
+			fctl++
+		}
+	}
+	return actl, fctl
+}
+
+func TestNumFramesIsFCTLCount(t *testing.T) {
+	a, b := testImage(4, 4, 0), testImage(4, 4, 1)
+	names := writePNGs(t, a, b, b, a)
+	tests := []struct {
+		name   string
+		o      *EncodeOptions
+		frames int
+	}{
+		{"default", nil, 4},
+		{"StaticDefault", &EncodeOptions{StaticDefault: true}, 3},
+		{"MergeDuplicates", &EncodeOptions{MergeDuplicates: true}, 3},
+		{"StaticDefault and MergeDuplicates", &EncodeOptions{StaticDefault: true, MergeDuplicates: true}, 2},
+	}
+	for _, test := range tests {
+		// A file, MergeDuplicates corrects acTL afterwards
+		f, err := ioutil.TempFile(t.TempDir(), "out")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = EncodeWithOptions(f, names, []int{1, 2, 3, 4}, test.o)
+		f.Close()
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		out, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		actl, fctl := numFrames(t, out)
+		if actl != fctl || fctl != test.frames {
+			t.Errorf("%s: acTL num_frames is %d and there are %d fcTL chunks, want %d", test.name, actl, fctl, test.frames)
+		}
+	}
+}
+
+// noiseImage returns a w x h image of random pixels, which hardly compress.
+func noiseImage(w, h int, seed uint32) *image.NRGBA {
+	m := image.NewNRGBA(image.Rect(0, 0, w, h))
+	x := seed | 1
+	for i := range m.Pix {
+		x ^= x << 13
+		x ^= x >> 17
+		x ^= x << 5
+		m.Pix[i] = uint8(x)
+	}
+	return m
+}
+
+// joinIDAT joins the IDAT chunks of the png files into one, image/png
+// writes many small ones.
+func joinIDAT(t testing.TB, names []string) {
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var chunks []chunk
+		for _, c := range readChunks(t, data) {
+			if c.name == "IDAT" && chunks[len(chunks)-1].name == "IDAT" {
+				last := &chunks[len(chunks)-1]
+				last.data = append(append([]byte(nil), last.data...), c.data...)
+				continue
+			}
+			chunks = append(chunks, c)
+		}
+		if err := ioutil.WriteFile(name, buildPNG(chunks), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// benchmarkFrames writes n frames of 512 KiB that compress badly, so that
+// copying the image data dominates, and returns their names and total size.
+// If join is true every frame has a single IDAT chunk.
+func benchmarkFrames(b *testing.B, n int, join bool) ([]string, int64) {
+	var imgs []image.Image
+	for i := 0; i < n; i++ {
+		imgs = append(imgs, noiseImage(256, 512, uint32(i)))
+	}
+	names := writePNGs(b, imgs...)
+	if join {
+		joinIDAT(b, names)
+	}
+	var size int64
+	for _, name := range names {
+		fi, err := os.Stat(name)
+		if err != nil {
+			b.Fatal(err)
+		}
+		size += fi.Size()
+	}
+	return names, size
+}
+
+func BenchmarkEncode(b *testing.B) {
+	tests := []struct {
+		name      string
+		join      bool
+		chunkSize int
+	}{
+		{"Direct", true, 0},   // every source IDAT is written directly
+		{"Split", true, 4096}, // the source IDATs are split into small chunks
+		{"Gather", false, 0},  // the small source IDATs are collected in the buffer
+	}
+	for _, test := range tests {
+		names, size := benchmarkFrames(b, 4, test.join)
+		delays := make([]int, len(names))
+		b.Run(test.name, func(b *testing.B) {
+			o := &EncodeOptions{ChunkSize: test.chunkSize}
+			b.SetBytes(size)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := EncodeWithOptions(ioutil.Discard, names, delays, o); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkParseChunk(b *testing.B) {
+	names, size := benchmarkFrames(b, 1, false)
+	data, err := ioutil.ReadFile(names[0])
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(size)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		// A new decoder every time, its size shows up in the allocations
+		d := &decoder{
+			r:   bufio.NewReader(bytes.NewReader(data)),
+			crc: crc32.NewIEEE(),
+		}
+		if err := d.checkHeader(); err != nil {
+			b.Fatal(err)
+		}
+		for d.ChunkName != "IEND" {
+			if _, err := d.parseChunk(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestDecodeFrameInThreeFDAT(t *testing.T) {
+	frames := []image.Image{testImage(16, 16, 0), testImage(16, 16, 50)}
+	var b bytes.Buffer
+	if err := Encode(&b, writePNGs(t, frames...), []int{10, 20}); err != nil {
+		t.Fatal(err)
+	}
+	// Split the image data of the second frame across three fdAT chunks
+	data := frameData(readChunks(t, b.Bytes()))[1]
+	var chunks []chunk
+	for _, c := range readChunks(t, b.Bytes()) {
+		if c.name != "fdAT" {
+			chunks = append(chunks, c)
+			continue
+		}
+		seq := binary.BigEndian.Uint32(c.data[0:4])
+		third := len(data) / 3
+		for i, part := range [][]byte{data[:third], data[third : 2*third], data[2*third:]} {
+			fdat := make([]byte, 4, 4+len(part))
+			binary.BigEndian.PutUint32(fdat, seq+uint32(i))
+			chunks = append(chunks, chunk{"fdAT", append(fdat, part...)})
+		}
+	}
+	crafted := buildPNG(chunks)
+	if err := Validate(bytes.NewReader(crafted)); err != nil {
+		t.Fatalf("the crafted APNG is invalid: %v", err)
+	}
+
+	got, delays, _, err := Decode(bytes.NewReader(crafted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || delays[1] != 200 {
+		t.Fatalf("%d frames with the delays %v", len(got), delays)
+	}
+	if !sameImage(got[1], frames[1]) {
+		t.Error("the frame in three fdAT chunks is not decoded correctly")
+	}
+}
+
+func TestDecode(t *testing.T) {
+	frames := []image.Image{testImage(8, 8, 0), testImage(8, 8, 100), testImage(8, 8, 200)}
+	var b bytes.Buffer
+	o := &EncodeOptions{Loop: 3}
+	if err := EncodeWithOptions(&b, writePNGs(t, frames...), []int{10, 20, 30}, o); err != nil {
+		t.Fatal(err)
+	}
+	got, delays, loop, err := Decode(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(frames) {
+		t.Fatalf("%d frames, want %d", len(got), len(frames))
+	}
+	for i := range frames {
+		if !sameImage(got[i], frames[i]) {
+			t.Errorf("frame %d is not decoded correctly", i)
+		}
+	}
+	if want := []int{100, 200, 300}; len(delays) != 3 || delays[0] != want[0] || delays[1] != want[1] || delays[2] != want[2] {
+		t.Errorf("delays %v, want %v", delays, want)
+	}
+	if loop != 3 {
+		t.Errorf("loop %d, want 3", loop)
+	}
+
+	// An acTL with the wrong number of frames
+	chunks := readChunks(t, b.Bytes())
+	for i, c := range chunks {
+		if c.name == "acTL" {
+			data := append([]byte(nil), c.data...)
+			binary.BigEndian.PutUint32(data[0:4], 2)
+			chunks[i].data = data
+		}
+	}
+	if _, _, _, err := Decode(bytes.NewReader(buildPNG(chunks))); err == nil {
+		t.Error("Decode accepted acTL num_frames 2 with three fcTL chunks")
+	}
+}
+
+func TestDecodeSubFrame(t *testing.T) {
+	canvas := testImage(8, 8, 0)
+	small := testImage(3, 2, 150)
+	var b bytes.Buffer
+	o := &EncodeOptions{Offsets: []image.Point{{}, {4, 5}}}
+	if err := EncodeWithOptions(&b, writePNGs(t, canvas, small), []int{1, 1}, o); err != nil {
+		t.Fatal(err)
+	}
+	got, _, _, err := Decode(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The second frame replaces its region of the first one
+	want := image.NewNRGBA(canvas.Bounds())
+	draw.Draw(want, want.Bounds(), canvas, image.ZP, draw.Src)
+	draw.Draw(want, image.Rect(4, 5, 7, 7), small, image.ZP, draw.Src)
+	if len(got) != 2 || !sameImage(got[1], want) {
+		t.Error("the sub-frame is not composited onto the canvas")
+	}
+}
+
+func TestDecodeTranslucent(t *testing.T) {
+	// Premultiplying alpha would change these colors
+	m := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	m16 := image.NewNRGBA64(m.Rect)
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			m.SetNRGBA(x, y, color.NRGBA{201, 57, 13, uint8(100 + x*y)})
+			m16.SetNRGBA64(x, y, color.NRGBA64{51201, 5700, 1313, uint16(1000 + x*y)})
+		}
+	}
+	for _, want := range []image.Image{m, m16} {
+		var b bytes.Buffer
+		if err := Encode(&b, writePNGs(t, want, want), []int{1, 1}); err != nil {
+			t.Fatal(err)
+		}
+		got, _, _, err := Decode(bytes.NewReader(b.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, frame := range got {
+			var same bool
+			switch want := want.(type) {
+			case *image.NRGBA:
+				f, ok := frame.(*image.NRGBA)
+				same = ok && bytes.Equal(f.Pix, want.Pix)
+			case *image.NRGBA64:
+				f, ok := frame.(*image.NRGBA64)
+				same = ok && bytes.Equal(f.Pix, want.Pix)
+			}
+			if !same {
+				t.Errorf("%T frame %d is not decoded exactly, got %T", want, i, frame)
+			}
+		}
+	}
+}
+
+func TestDecodeCanvasSize(t *testing.T) {
+	var b bytes.Buffer
+	if err := Encode(&b, writePNGs(t, testImage(2, 2, 0), testImage(2, 2, 1)), []int{1, 1}); err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range [][2]uint32{{0x7fffffff, 0x7fffffff}, {0x80000000, 1}, {0, 2}, {1 << 15, 1 << 15}} {
+		chunks := readChunks(t, b.Bytes())
+		ihdr := append([]byte(nil), chunks[0].data...)
+		binary.BigEndian.PutUint32(ihdr[0:4], size[0])
+		binary.BigEndian.PutUint32(ihdr[4:8], size[1])
+		chunks[0].data = ihdr
+		_, _, _, err := Decode(bytes.NewReader(buildPNG(chunks)))
+		if _, ok := err.(FormatError); !ok {
+			t.Errorf("%d x %d canvas: got %v, want a FormatError", size[0], size[1], err)
+		}
+	}
+}
+
+func TestValidateDataLength(t *testing.T) {
+	var b bytes.Buffer
+	if err := Encode(&b, writePNGs(t, testImage(8, 8, 0), testImage(8, 8, 1)), []int{1, 1}); err != nil {
+		t.Fatal(err)
+	}
+	o := &DecodeOptions{CheckDataLength: true}
+	if err := ValidateWithOptions(bytes.NewReader(b.Bytes()), o); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second frame loses a byte of its last row, the crc is still valid
+	for _, n := range []int{8*(1+8*3) - 1, 8*(1+8*3) + 1} {
+		var z bytes.Buffer
+		zw := zlib.NewWriter(&z)
+		zw.Write(make([]byte, n))
+		zw.Close()
+		chunks := readChunks(t, b.Bytes())
+		for i, c := range chunks {
+			if c.name == "fdAT" {
+				chunks[i].data = append(append([]byte(nil), c.data[:4]...), z.Bytes()...)
+			}
+		}
+		crafted := buildPNG(chunks)
+		if err := Validate(bytes.NewReader(crafted)); err != nil {
+			t.Errorf("%d bytes: Validate checks the data length: %v", n, err)
+		}
+		err := ValidateWithOptions(bytes.NewReader(crafted), o)
+		if _, ok := err.(FormatError); !ok {
+			t.Errorf("%d bytes: got %v, want a FormatError", n, err)
+		}
+	}
+
+	// Adam7 has a filter byte per row of every pass that is not empty
+	for _, test := range []struct {
+		w, h int
+		want int64
+	}{{1, 1, 2}, {2, 2, 2 + 2 + 3}, {8, 8, 2 + 2 + 3 + 2*3 + 2*5 + 4*5 + 4*9}} {
+		ihdr := []byte{0, 0, 0, 0, 0, 0, 0, 0, 8, 0, 0, 0, 1}
+		if got := rawDataLength(test.w, test.h, ihdr); got != test.want {
+			t.Errorf("interlaced %d x %d gray: %d bytes, want %d", test.w, test.h, got, test.want)
+		}
+	}
+}
+
+func TestAppend(t *testing.T) {
+	frames := []image.Image{testImage(8, 8, 0), testImage(8, 8, 100), testImage(8, 8, 200)}
+	names := writePNGs(t, append(frames, testImage(4, 4, 0))...)
+	f, err := ioutil.TempFile(t.TempDir(), "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := EncodeWithOptions(f, names[:2], []int{10, 20}, &EncodeOptions{Loop: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if err := Append(f, names[2:3], []int{30}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if err := Append(f, names[3:], []int{30}); err == nil {
+		t.Error("Append accepted a frame smaller than the canvas")
+	}
+
+	out, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Validate(bytes.NewReader(out)); err != nil {
+		t.Fatal(err)
+	}
+	got, delays, loop, err := Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || loop != 2 || delays[2] != 300 {
+		t.Fatalf("%d frames with the delays %v and loop %d, want 3 frames ending in 300 and loop 2", len(got), delays, loop)
+	}
+	for i := range frames {
+		if !sameImage(got[i], frames[i]) {
+			t.Errorf("frame %d is not decoded correctly", i)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a := testImage(8, 8, 0)
+	b := testImage(8, 8, 0)
+	b.SetNRGBA(5, 2, color.NRGBA{255, 0, 0, 255})
+	b.SetNRGBA(6, 3, color.NRGBA{0, 255, 0, 255})
+	var out bytes.Buffer
+	// The third frame does not change anything
+	if err := EncodeImagesWithOptions(&out, []image.Image{a, b, b}, []int{10, 20, 30}, &EncodeOptions{Diff: true}); err != nil {
+		t.Fatal(err)
+	}
+	var regions []image.Rectangle
+	for _, c := range readChunks(t, out.Bytes()) {
+		if c.name == "fcTL" {
+			x, y := int(binary.BigEndian.Uint32(c.data[12:16])), int(binary.BigEndian.Uint32(c.data[16:20]))
+			w, h := int(binary.BigEndian.Uint32(c.data[4:8])), int(binary.BigEndian.Uint32(c.data[8:12]))
+			regions = append(regions, image.Rect(x, y, x+w, y+h))
+		}
+	}
+	if want := []image.Rectangle{a.Bounds(), image.Rect(5, 2, 7, 4)}; len(regions) != 2 || regions[0] != want[0] || regions[1] != want[1] {
+		t.Errorf("frame regions %v, want %v", regions, want)
+	}
+	got, delays, _, err := Decode(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || !sameImage(got[0], a) || !sameImage(got[1], b) {
+		t.Error("the frames are not decoded as they were given")
+	}
+	if len(delays) != 2 || delays[1] != 500 {
+		t.Errorf("delays %v, the delay of the unchanged frame is not added", delays)
+	}
+}
+
+func TestInferDisposal(t *testing.T) {
+	// A sprite that moves over a transparent canvas is cleared, a popup over
+	// a background is replaced by what was there before
+	var sprite, popup []image.Image
+	for i := 0; i < 4; i++ {
+		m := image.NewNRGBA(image.Rect(0, 0, 24, 8))
+		draw.Draw(m, image.Rect(6*i, 2, 6*i+4, 6), testImage(4, 4, uint8(50*i)), image.ZP, draw.Src)
+		sprite = append(sprite, m)
+		m = testImage(24, 8, 0)
+		if i%2 == 1 {
+			draw.Draw(m, image.Rect(3*i, 1, 3*i+5, 4), image.NewUniform(color.NRGBA{200, 0, uint8(i), 100}), image.ZP, draw.Src)
+		}
+		popup = append(popup, m)
+	}
+	for _, test := range []struct {
+		name    string
+		frames  []image.Image
+		dispose DisposeOp
+	}{{"sprite", sprite, DisposeOpBackground}, {"popup", popup, DisposeOpPrevious}} {
+		var out bytes.Buffer
+		if err := EncodeImagesWithOptions(&out, test.frames, []int{1, 2, 3, 4}, &EncodeOptions{InferDisposal: true}); err != nil {
+			t.Fatal(err)
+		}
+		inferred := false
+		for _, c := range readChunks(t, out.Bytes()) {
+			inferred = inferred || c.name == "fcTL" && DisposeOp(c.data[24]) == test.dispose
+		}
+		if !inferred {
+			t.Errorf("%s: no frame has the dispose op %d", test.name, test.dispose)
+		}
+		got, _, _, err := Decode(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(test.frames) {
+			t.Fatalf("%s: %d frames, want %d", test.name, len(got), len(test.frames))
+		}
+		for i, frame := range test.frames {
+			if !bytes.Equal(got[i].(*image.NRGBA).Pix, frame.(*image.NRGBA).Pix) {
+				t.Errorf("%s: frame %d is not decoded as it was given", test.name, i)
+			}
+		}
+	}
+}
+
+func TestMergeDuplicates(t *testing.T) {
+	a, b := testImage(8, 8, 0), testImage(8, 8, 100)
+	names := writePNGs(t, a, a, a, b, b)
+	for _, concurrency := range []int{0, 3} {
+		f, err := ioutil.TempFile(t.TempDir(), "out")
+		if err != nil {
+			t.Fatal(err)
+		}
+		o := &EncodeOptions{MergeDuplicates: true, Concurrency: concurrency}
+		err = EncodeWithOptions(f, names, []int{10, 20, 30, 40, 50}, o)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Validate(bytes.NewReader(out)); err != nil {
+			t.Fatalf("concurrency %d: %v", concurrency, err)
+		}
+		got, delays, _, err := Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 2 || !sameImage(got[0], a) || !sameImage(got[1], b) {
+			t.Errorf("concurrency %d: %d frames, want the two different ones", concurrency, len(got))
+		}
+		if len(delays) != 2 || delays[0] != 600 || delays[1] != 900 {
+			t.Errorf("concurrency %d: delays %v, want [600 900]", concurrency, delays)
+		}
+	}
+
+	// The fcTL chunks are corrected in memory for a writer that cannot seek
+	f, err := ioutil.TempFile(t.TempDir(), "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = EncodeWithOptions(f, names, []int{10, 20, 30, 40, 50}, &EncodeOptions{MergeDuplicates: true})
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := EncodeWithOptions(&out, names, []int{10, 20, 30, 40, 50}, &EncodeOptions{MergeDuplicates: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Error("MergeDuplicates without io.WriteSeeker does not write the same file")
+	}
+
+	// All the frames are the same, the output becomes a PNG without animation
+	out.Reset()
+	if err := EncodeWithOptions(&out, names[:3], []int{10, 20, 30}, &EncodeOptions{MergeDuplicates: true}); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := numFrames(t, out.Bytes()); n != -1 {
+		t.Errorf("acTL with %d frames for one frame without io.WriteSeeker", n)
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	var imgs []image.Image
+	for i := 0; i < 7; i++ {
+		imgs = append(imgs, testImage(32, 32, uint8(30*i)))
+	}
+	names := writePNGs(t, imgs...)
+	delays := []int{1, 2, 3, 4, 5, 6, 7}
+	for _, chunkSize := range []int{0, minChunkSize} {
+		var serial bytes.Buffer
+		if err := EncodeWithOptions(&serial, names, delays, &EncodeOptions{ChunkSize: chunkSize}); err != nil {
+			t.Fatal(err)
+		}
+		for _, concurrency := range []int{2, 4, 16} {
+			var progress []int
+			o := &EncodeOptions{
+				ChunkSize:   chunkSize,
+				Concurrency: concurrency,
+				Progress:    func(i int, name string) { progress = append(progress, i) },
+			}
+			var b bytes.Buffer
+			if err := EncodeWithOptions(&b, names, delays, o); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b.Bytes(), serial.Bytes()) {
+				t.Errorf("chunk size %d, concurrency %d: the output differs from the serial one", chunkSize, concurrency)
+			}
+			for i, p := range progress {
+				if p != i {
+					t.Errorf("chunk size %d, concurrency %d: Progress was called for %v, not in order", chunkSize, concurrency, progress)
+					break
+				}
+			}
+		}
+	}
+
+	// A frame that cannot be read stops the encoding
+	broken := append(append([]string(nil), names...), filepath.Join(t.TempDir(), "missing.png"))
+	var b bytes.Buffer
+	if err := EncodeWithOptions(&b, broken, append(delays, 8), &EncodeOptions{Concurrency: 4}); err == nil {
+		t.Error("a missing frame did not fail")
+	}
+}
+
+func TestFrameSize(t *testing.T) {
+	names := writePNGs(t, testImage(10, 10, 0), testImage(5, 5, 0))
+	var b bytes.Buffer
+	if err := Encode(&b, names, []int{1, 1}); err == nil {
+		t.Error("Encode accepted a frame smaller than the first one")
+	} else if _, ok := err.(FormatError); !ok {
+		t.Errorf("%v is not a FormatError", err)
+	}
+
+	// Sub-frames with offsets
+	b.Reset()
+	o := &EncodeOptions{Offsets: []image.Point{{}, {5, 5}}}
+	if err := EncodeWithOptions(&b, names, []int{1, 1}, o); err != nil {
+		t.Errorf("Offsets: %v", err)
+	}
+	b.Reset()
+	o = &EncodeOptions{Offsets: []image.Point{{}, {6, 0}}}
+	if err := EncodeWithOptions(&b, names, []int{1, 1}, o); err == nil {
+		t.Error("a frame that does not fit into the canvas at its offset was accepted")
+	}
+
+	// Sub-frames with their bounds
+	b.Reset()
+	canvas := testImage(10, 10, 0)
+	if err := EncodeImages(&b, []image.Image{canvas, canvas.SubImage(image.Rect(2, 3, 7, 8))}, []int{1, 1}); err != nil {
+		t.Errorf("EncodeImages with a smaller frame: %v", err)
+	}
+}
+
+func TestChunkSizeIsMaximum(t *testing.T) {
+	// A single source IDAT larger than 1 MiB
+	imgs := []image.Image{noiseImage(600, 600, 1), noiseImage(600, 600, 2)}
+	names := writePNGs(t, imgs...)
+	joinIDAT(t, names)
+	var want [][]byte
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range readChunks(t, data) {
+			if c.name == "IDAT" {
+				if len(c.data) <= maxChunkSize {
+					t.Fatalf("the IDAT chunk of %s has only %d bytes", name, len(c.data))
+				}
+				want = append(want, c.data)
+			}
+		}
+	}
+
+	for _, chunkSize := range []int{0, 4096, minChunkSize} {
+		var b bytes.Buffer
+		if err := EncodeWithOptions(&b, names, []int{1, 1}, &EncodeOptions{ChunkSize: chunkSize}); err != nil {
+			t.Fatal(err)
+		}
+		max := chunkSize
+		if max == 0 {
+			max = maxChunkSize
+		}
+		chunks := readChunks(t, b.Bytes())
+		for _, c := range chunks {
+			if (c.name == "IDAT" || c.name == "fdAT") && 12+len(c.data) > max {
+				t.Errorf("chunk size %d: %s chunk of %d bytes", chunkSize, c.name, 12+len(c.data))
+				break
+			}
+		}
+		for i, data := range frameData(chunks) {
+			if !bytes.Equal(data, want[i]) {
+				t.Errorf("chunk size %d: the image data of frame %d differs", chunkSize, i)
+			}
+		}
+	}
+}
+
+// plainImage hides the methods of the image it wraps, e.g. Opaque.
+type plainImage struct{ image.Image }
+
+func TestEncodeImagesMixedOpacity(t *testing.T) {
+	opaque := plainImage{testImage(4, 4, 0)}
+	transparent := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	transparent.SetNRGBA(1, 1, color.NRGBA{255, 0, 0, 128})
+	for _, frames := range [][]image.Image{{opaque, transparent}, {transparent, opaque}} {
+		var b bytes.Buffer
+		if err := EncodeImages(&b, frames, []int{1, 1}); err != nil {
+			t.Error(err)
+			continue
+		}
+		got, _, _, err := Decode(bytes.NewReader(b.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range frames {
+			if !sameImage(got[i], frames[i]) {
+				t.Errorf("frame %d is not decoded correctly", i)
+			}
+		}
+	}
+}
+
+func TestText(t *testing.T) {
+	names := writePNGs(t, testImage(4, 4, 0), testImage(4, 4, 1))
+	tests := []struct {
+		value string
+		chunk string // chunk the value is written in, empty if it is invalid
+	}{
+		{"made with apng", "tEXt"},
+		{"grüße", "iTXt"},
+		{"a\x00b", ""},
+		{"\xff\xfe", ""},
+	}
+	for _, test := range tests {
+		var b bytes.Buffer
+		o := &EncodeOptions{Text: map[string]string{"Comment": test.value}}
+		err := EncodeWithOptions(&b, names, []int{1, 1}, o)
+		if test.chunk == "" {
+			if _, ok := err.(FormatError); !ok {
+				t.Errorf("%q: %v is not a FormatError", test.value, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.value, err)
+			continue
+		}
+		found := false
+		for _, c := range readChunks(t, b.Bytes()) {
+			if c.name == test.chunk && textKeyword(c.data) == "Comment" {
+				found = bytes.HasSuffix(c.data, []byte(test.value))
+			}
+		}
+		if !found {
+			t.Errorf("%q is not written as %s", test.value, test.chunk)
+		}
+	}
+}
+
+func TestDurationDelays(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want Delay // Den 0 if it is an error
+	}{
+		{0, Delay{0, 1}},
+		{100 * time.Millisecond, Delay{1, 10}},
+		{33333333, Delay{1, 30}},
+		{time.Second / 3, Delay{1, 3}},
+		{1001 * time.Second / 24000, Delay{1001, 24000}},
+		{time.Nanosecond, Delay{}},
+		{70000 * time.Second, Delay{}},
+	}
+	for _, test := range tests {
+		got, err := DurationDelays([]time.Duration{test.d})
+		if test.want.Den == 0 {
+			if err == nil {
+				t.Errorf("%v: got %v, want an error", test.d, got)
+			}
+			continue
+		}
+		if err != nil || got[0] != test.want {
+			t.Errorf("%v: got %v, %v, want %v", test.d, got, err, test.want)
+		}
+	}
+
+	// Delays in microseconds that do not fit into fcTL get the same
+	// fraction as the durations
+	o := &EncodeOptions{TimeBase: Rational{1, 1000000}}
+	for _, us := range []int{33333, 41708, 1234567, 99999999} {
+		fractions, err1 := fractionDelays([]int{us}, o)
+		durations, err2 := DurationDelays([]time.Duration{time.Duration(us) * time.Microsecond})
+		if (err1 == nil) != (err2 == nil) || err1 == nil && fractions[0] != durations[0] {
+			t.Errorf("%dµs: %v, %v as int and %v, %v as duration", us, fractions, err1, durations, err2)
+		}
+	}
+}
+
+// rawNRGBA returns the zlib stream of the unfiltered scanlines of m, the
+// image data AddRawFrame expects.
+func rawNRGBA(m *image.NRGBA) []byte {
+	var b bytes.Buffer
+	zw := zlib.NewWriter(&b)
+	for y := 0; y < m.Rect.Dy(); y++ {
+		zw.Write([]byte{0})
+		zw.Write(m.Pix[y*m.Stride : y*m.Stride+4*m.Rect.Dx()])
+	}
+	zw.Close()
+	return b.Bytes()
+}
+
+func TestAddRawFrame(t *testing.T) {
+	frames := []*image.NRGBA{testImage(8, 6, 0), testImage(8, 6, 100), testImage(3, 2, 200)}
+	f, err := ioutil.TempFile(t.TempDir(), "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	enc := NewEncoder(f, 8, 6, 0)
+	if err := enc.AddRawFrame(rawNRGBA(frames[2]), 3, 2, 10); err == nil {
+		t.Error("a first frame smaller than the canvas was accepted")
+	}
+	for i, m := range frames {
+		if err := enc.AddRawFrame(rawNRGBA(m), int32(m.Rect.Dx()), int32(m.Rect.Dy()), 10*(i+1)); err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+	}
+	if err := enc.AddRawFrame(rawNRGBA(frames[0]), 9, 6, 10); err == nil {
+		t.Error("a frame larger than the canvas was accepted")
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Validate(bytes.NewReader(out)); err != nil {
+		t.Fatal(err)
+	}
+	got, delays, _, err := Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || delays[2] != 300 {
+		t.Fatalf("%d frames with the delays %v", len(got), delays)
+	}
+	if !sameImage(got[0], frames[0]) || !sameImage(got[1], frames[1]) {
+		t.Error("the frames are not decoded as they were given")
+	}
+	// The small frame is at 0, 0 over the second frame
+	if !sameImage(got[2].(interface {
+		SubImage(image.Rectangle) image.Image
+	}).SubImage(image.Rect(0, 0, 3, 2)), frames[2]) {
+		t.Error("the small frame is not at 0, 0")
+	}
+}
+
+func TestEncodeImagesFunc(t *testing.T) {
+	frames := []image.Image{testImage(4, 4, 0), testImage(4, 4, 1), testImage(4, 4, 2)}
+	var calls []int
+	delay := func(i int) time.Duration {
+		calls = append(calls, i)
+		return time.Duration(i+1) * time.Second / 3
+	}
+	var b bytes.Buffer
+	if err := EncodeImagesFunc(&b, frames, delay, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 3 || calls[0] != 0 || calls[1] != 1 || calls[2] != 2 {
+		t.Errorf("delay was called for %v", calls)
+	}
+	var got []Delay
+	for _, c := range readChunks(t, b.Bytes()) {
+		if c.name == "fcTL" {
+			got = append(got, Delay{binary.BigEndian.Uint16(c.data[20:22]), binary.BigEndian.Uint16(c.data[22:24])})
+		}
+	}
+	if want := []Delay{{1, 3}, {2, 3}, {1, 1}}; len(got) != 3 || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("fcTL delays %v, want %v", got, want)
+	}
+
+	negative := func(i int) time.Duration { return -time.Second }
+	if err := EncodeImagesFunc(&b, frames, negative, nil); err == nil {
+		t.Error("a negative delay was accepted")
+	}
+}
+
+func TestPosterImage(t *testing.T) {
+	frames := []image.Image{testImage(4, 4, 0), testImage(4, 4, 100)}
+	poster := image.NewRGBA(image.Rect(10, 10, 14, 14))
+	for i := range poster.Pix {
+		poster.Pix[i] = 255
+	}
+	var progress []int
+	o := &EncodeOptions{
+		PosterImage: poster,
+		Progress:    func(i int, name string) { progress = append(progress, i) },
+	}
+	var b bytes.Buffer
+	if err := EncodeImagesWithOptions(&b, frames, []int{10, 20}, o); err != nil {
+		t.Fatal(err)
+	}
+	// The poster is the default image, the frames are the animation
+	img, err := png.Decode(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameImage(img, poster) {
+		t.Error("png.Decode does not return the poster")
+	}
+	got, delays, _, err := Decode(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || !sameImage(got[0], frames[0]) || !sameImage(got[1], frames[1]) || delays[1] != 200 {
+		t.Errorf("%d frames with the delays %v, want the two frames", len(got), delays)
+	}
+	if len(progress) != 2 || progress[0] != 0 || progress[1] != 1 {
+		t.Errorf("Progress was called for %v, want the indices of the frames", progress)
+	}
+
+	o = &EncodeOptions{PosterImage: testImage(3, 4, 0)}
+	if err := EncodeImagesWithOptions(&b, frames, []int{10, 20}, o); err == nil {
+		t.Error("a poster of another size was accepted")
+	}
+	o = &EncodeOptions{PosterImage: poster, StaticDefault: true}
+	if err := EncodeImagesWithOptions(&b, frames, []int{10, 20}, o); err == nil {
+		t.Error("PosterImage with StaticDefault was accepted")
+	}
+}
+
+func TestSingleFrameIsPNG(t *testing.T) {
+	a := testImage(4, 4, 0)
+	names := writePNGs(t, a, a, a)
+	noAnimation := func(name string, b []byte) {
+		for _, c := range readChunks(t, b) {
+			if c.name == "acTL" || c.name == "fcTL" || c.name == "fdAT" {
+				t.Errorf("%s: %s chunk in a PNG without animation", name, c.name)
+			}
+		}
+		img, err := png.Decode(bytes.NewReader(b))
+		if err != nil || !sameImage(img, a) {
+			t.Errorf("%s: png.Decode: %v", name, err)
+		}
+	}
+
+	var b bytes.Buffer
+	if err := Encode(&b, names[:1], []int{10}); err != nil {
+		t.Fatal(err)
+	}
+	noAnimation("one file", b.Bytes())
+
+	// The duplicates are merged into the first frame, which is then the only one
+	f, err := ioutil.TempFile(t.TempDir(), "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = EncodeWithOptions(f, names, []int{10, 10, 10}, &EncodeOptions{MergeDuplicates: true})
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	noAnimation("merged", out)
+}
+
+func TestWatermark(t *testing.T) {
+	frames := []image.Image{testImage(8, 8, 0), testImage(8, 8, 100)}
+	var b bytes.Buffer
+	o := &EncodeOptions{Loop: 3, DelayDenominator: 3}
+	if err := EncodeWithOptions(&b, writePNGs(t, frames...), []int{1, 2}, o); err != nil {
+		t.Fatal(err)
+	}
+	// A translucent logo with a transparent pixel, partly outside of the canvas
+	logo := image.NewNRGBA(image.Rect(10, 10, 13, 13))
+	draw.Draw(logo, logo.Bounds(), image.NewUniform(color.NRGBA{255, 0, 0, 128}), image.ZP, draw.Src)
+	logo.SetNRGBA(10, 10, color.NRGBA{})
+	var out bytes.Buffer
+	if err := Watermark(bytes.NewReader(b.Bytes()), logo, 6, 5, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	got, _, loop, err := Decode(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || loop != 3 {
+		t.Fatalf("%d frames and loop %d, want 2 frames and loop 3", len(got), loop)
+	}
+	for i, frame := range frames {
+		want := image.NewNRGBA(frame.Bounds())
+		draw.Draw(want, want.Bounds(), frame, image.ZP, draw.Src)
+		draw.Draw(want, image.Rect(6, 5, 9, 8), logo, logo.Bounds().Min, draw.Over)
+		for y := 0; y < 8; y++ {
+			for x := 0; x < 8; x++ {
+				c, w := got[i].At(x, y).(color.NRGBA), want.NRGBAAt(x, y)
+				near := func(a, b uint8) bool { return a-b < 2 || b-a < 2 }
+				if !near(c.R, w.R) || !near(c.G, w.G) || !near(c.B, w.B) || c.A != w.A {
+					t.Errorf("frame %d: pixel %d, %d is %v, want %v", i, x, y, c, w)
+				}
+			}
+		}
+	}
+	var fractions []Delay
+	for _, c := range readChunks(t, out.Bytes()) {
+		if c.name == "fcTL" {
+			fractions = append(fractions, Delay{binary.BigEndian.Uint16(c.data[20:22]), binary.BigEndian.Uint16(c.data[22:24])})
+		}
+	}
+	if len(fractions) != 2 || fractions[0] != (Delay{1, 3}) || fractions[1] != (Delay{2, 3}) {
+		t.Errorf("delays %v, want 1/3 and 2/3", fractions)
+	}
+}
+
+func TestOnionSkin(t *testing.T) {
+	// A dot that moves to the right on a transparent canvas
+	var frames []image.Image
+	for i := 0; i < 3; i++ {
+		m := image.NewNRGBA(image.Rect(0, 0, 4, 1))
+		m.SetNRGBA(i, 0, color.NRGBA{uint8(100 * i), 50, 0, 255})
+		frames = append(frames, m)
+	}
+	var b bytes.Buffer
+	if err := EncodeImagesWithOptions(&b, frames, []int{10, 20, 30}, &EncodeOptions{Loop: 2}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		fade  float64
+		alpha [3]uint8 // the alpha of the three dots in the last frame
+	}{{1, [3]uint8{0, 0, 255}}, {0.5, [3]uint8{64, 128, 255}}, {0, [3]uint8{255, 255, 255}}}
+	for _, test := range tests {
+		var out bytes.Buffer
+		if err := OnionSkin(bytes.NewReader(b.Bytes()), &out, test.fade); err != nil {
+			t.Fatal(err)
+		}
+		got, delays, loop, err := Decode(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 3 || delays[0] != 100 || delays[2] != 300 || loop != 2 {
+			t.Fatalf("fade %v: %d frames with the delays %v and loop %d", test.fade, len(got), delays, loop)
+		}
+		if !sameImage(got[0], frames[0]) {
+			t.Errorf("fade %v: the first frame has changed", test.fade)
+		}
+		last := got[2].(*image.NRGBA)
+		for x, alpha := range test.alpha {
+			c := last.NRGBAAt(x, 0)
+			if c.A != alpha || alpha != 0 && c.R != uint8(100*x) {
+				t.Errorf("fade %v: dot %d is %v, want the alpha %d", test.fade, x, c, alpha)
+			}
+		}
+	}
+	for _, fade := range []float64{-0.1, 1.5, math.NaN()} {
+		if err := OnionSkin(bytes.NewReader(b.Bytes()), ioutil.Discard, fade); err == nil {
+			t.Errorf("fade %v was accepted", fade)
+		}
+	}
+}
+
+func TestOptimizeAlpha(t *testing.T) {
+	// A sprite that moves over a transparent background
+	var frames []image.Image
+	for i := 0; i < 3; i++ {
+		sprite := noiseImage(12, 12, uint32(i))
+		for j := 3; j < len(sprite.Pix); j += 4 {
+			sprite.Pix[j] = 0xff
+		}
+		m := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+		draw.Draw(m, image.Rect(4*i, 8, 4*i+12, 20), sprite, image.ZP, draw.Src)
+		frames = append(frames, m)
+	}
+	encode := func(o *EncodeOptions) []byte {
+		var b bytes.Buffer
+		if err := EncodeImagesWithOptions(&b, frames, []int{1, 1, 1}, o); err != nil {
+			t.Fatal(err)
+		}
+		return b.Bytes()
+	}
+	plain, optimized := encode(nil), encode(&EncodeOptions{OptimizeAlpha: true})
+	chunks := readChunks(t, optimized)
+	trns := false
+	for _, c := range chunks {
+		if c.name == "IDAT" {
+			break
+		}
+		trns = trns || c.name == "tRNS" && len(c.data) == 6
+	}
+	if chunks[0].data[9] != 2 || !trns {
+		t.Errorf("color type %d and tRNS %v, want color type 2 with tRNS", chunks[0].data[9], trns)
+	}
+	if len(optimized) >= len(plain) {
+		t.Errorf("%d bytes with OptimizeAlpha, %d bytes without", len(optimized), len(plain))
+	}
+
+	// Both look the same, the transparent pixels may have another color
+	a, _, _, err := Decode(bytes.NewReader(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _, _, err := Decode(bytes.NewReader(optimized))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range frames {
+		for y := 0; y < 32; y++ {
+			for x := 0; x < 32; x++ {
+				ca, cb := a[i].At(x, y).(color.NRGBA), b[i].At(x, y).(color.NRGBA)
+				if ca != cb && (ca.A != 0 || cb.A != 0) {
+					t.Fatalf("frame %d: pixel %d, %d is %v, want %v", i, x, y, cb, ca)
+				}
+			}
+		}
+	}
+
+	// A translucent pixel needs the alpha channel
+	translucent := image.NewNRGBA(frames[0].Bounds())
+	translucent.SetNRGBA(0, 0, color.NRGBA{1, 2, 3, 4})
+	frames[2] = translucent
+	if c := readChunks(t, encode(&EncodeOptions{OptimizeAlpha: true})); c[0].data[9] != 6 {
+		t.Errorf("color type %d with a translucent pixel, want 6", c[0].data[9])
+	}
+}
+
+func TestContext(t *testing.T) {
+	frames := []image.Image{testImage(8, 8, 0), testImage(8, 8, 100), testImage(8, 8, 200)}
+	names := writePNGs(t, frames...)
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	var b bytes.Buffer
+	if err := EncodeWithOptions(&b, names, []int{1, 1, 1}, &EncodeOptions{Context: canceled}); err != context.Canceled {
+		t.Errorf("got %v with a canceled context, want context.Canceled", err)
+	}
+	if b.Len() != 0 {
+		t.Errorf("%d bytes were written with a canceled context", b.Len())
+	}
+	if err := EncodeImagesWithOptions(&b, frames, []int{1, 1, 1}, &EncodeOptions{Context: canceled}); err != context.Canceled {
+		t.Errorf("EncodeImagesWithOptions: got %v with a canceled context, want context.Canceled", err)
+	}
+
+	// Canceled after the first frame
+	for _, concurrency := range []int{0, 2} {
+		ctx, cancel := context.WithCancel(context.Background())
+		o := &EncodeOptions{Context: ctx, Concurrency: concurrency, Progress: func(frameIndex int, filename string) {
+			if frameIndex == 0 {
+				cancel()
+			}
+		}}
+		b.Reset()
+		if err := EncodeWithOptions(&b, names, []int{1, 1, 1}, o); err != context.Canceled {
+			t.Errorf("concurrency %d: got %v, want context.Canceled", concurrency, err)
+		}
+		if _, fctl := numFrames(t, b.Bytes()); fctl == 3 {
+			t.Errorf("concurrency %d: all frames were written", concurrency)
+		}
+		cancel()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b.Reset()
+	enc := NewEncoder(&b, 8, 8, 0)
+	enc.Frames = 2
+	enc.Context = ctx
+	if err := enc.AddFrame(frames[0], 1); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := enc.AddFrame(frames[1], 1); err != context.Canceled {
+		t.Errorf("AddFrame: got %v, want context.Canceled", err)
+	}
+	if err := enc.AddRawFrame([]byte{1}, 8, 8, 1); err != context.Canceled {
+		t.Errorf("AddRawFrame: got %v, want context.Canceled", err)
+	}
+}
+
+func TestTranscode(t *testing.T) {
+	// The frames are 5 pixels wide, so the rows of bit depths below 8 end
+	// in a partial byte
+	bounds := image.Rect(0, 0, 5, 3)
+	var tests []struct {
+		name          string
+		first, second image.Image
+		bitDepth      uint8
+	}
+	add := func(name string, first, second image.Image, bitDepth uint8) {
+		tests = append(tests, struct {
+			name          string
+			first, second image.Image
+			bitDepth      uint8
+		}{name, first, second, bitDepth})
+	}
+	for _, n := range []int{2, 4, 16} {
+		pal := make(color.Palette, n)
+		for i := range pal {
+			pal[i] = color.NRGBA{uint8(i * 15), uint8(255 - i*15), uint8(i * 7), 255}
+		}
+		first := image.NewPaletted(bounds, pal)
+		second := image.NewNRGBA(bounds)
+		for y := 0; y < 3; y++ {
+			for x := 0; x < 5; x++ {
+				first.SetColorIndex(x, y, uint8((x+y)%n))
+				second.Set(x, y, pal[(x*3+y)%n])
+			}
+		}
+		add(strconv.Itoa(n)+" colors", first, second, map[int]uint8{2: 1, 4: 2, 16: 4}[n])
+	}
+	gray16 := image.NewGray16(bounds)
+	gray := image.NewNRGBA(bounds)
+	deep := image.NewNRGBA64(bounds)
+	translucent := image.NewNRGBA(bounds)
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 5; x++ {
+			gray16.SetGray16(x, y, color.Gray16{uint16(x*10000 + y)})
+			v := uint8(x*50 + y)
+			gray.SetNRGBA(x, y, color.NRGBA{v, v, v, 255})
+			deep.SetNRGBA64(x, y, color.NRGBA64{uint16(x * 9000), 300, uint16(y * 20000), uint16(1000 + x)})
+			translucent.SetNRGBA(x, y, color.NRGBA{201, 57, uint8(x * 60), uint8(1 + y*100)})
+		}
+	}
+	add("gray16", gray16, gray, 16)
+	add("nrgba64", deep, translucent, 16)
+
+	for _, test := range tests {
+		var b bytes.Buffer
+		names := writePNGs(t, test.first, test.second)
+		if err := EncodeWithOptions(&b, names, []int{1, 1}, &EncodeOptions{Transcode: true}); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if err := ValidateWithOptions(bytes.NewReader(b.Bytes()), &DecodeOptions{CheckDataLength: true}); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if ihdr := readChunks(t, b.Bytes())[0].data; ihdr[8] != test.bitDepth {
+			t.Errorf("%s: bit depth %d, want %d", test.name, ihdr[8], test.bitDepth)
+		}
+		got, _, _, err := Decode(bytes.NewReader(b.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		for i, want := range []image.Image{test.first, test.second} {
+			for y := 0; y < 3; y++ {
+				for x := 0; x < 5; x++ {
+					if c, w := got[i].At(x, y), want.At(x, y); nrgba64(c) != nrgba64(w) {
+						t.Errorf("%s: frame %d pixel %d, %d is %v, want %v", test.name, i, x, y, c, w)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeGIF(t *testing.T) {
+	red, green, blue := color.RGBA{255, 0, 0, 255}, color.RGBA{0, 255, 0, 255}, color.RGBA{0, 0, 255, 255}
+	pal := color.Palette{color.RGBA{}, red, green, blue}
+	fill := func(r image.Rectangle, index uint8) *image.Paletted {
+		m := image.NewPaletted(r, pal)
+		for i := range m.Pix {
+			m.Pix[i] = index
+		}
+		return m
+	}
+	g := &gif.GIF{
+		Image: []*image.Paletted{
+			fill(image.Rect(0, 0, 4, 2), 1),
+			fill(image.Rect(0, 0, 2, 1), 2), // replaced by the frame before
+			fill(image.Rect(2, 1, 4, 2), 3), // cleared
+			fill(image.Rect(1, 1, 2, 2), 2),
+		},
+		Delay:    []int{10, 20, 30, 40},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalPrevious, gif.DisposalBackground, gif.DisposalNone},
+		Config:   image.Config{Width: 4, Height: 2},
+	}
+	// The canvases as they are shown, by row
+	want := [][8]color.Color{
+		{red, red, red, red, red, red, red, red},
+		{green, green, red, red, red, red, red, red},
+		{red, red, red, red, red, red, blue, blue},
+		{red, red, red, red, red, green, color.RGBA{}, color.RGBA{}},
+	}
+	for _, test := range []struct{ loopCount, loop int }{{0, 0}, {-1, 1}, {2, 3}} {
+		g.LoopCount = test.loopCount
+		var b bytes.Buffer
+		if err := EncodeGIF(&b, g); err != nil {
+			t.Fatal(err)
+		}
+		got, delays, loop, err := Decode(bytes.NewReader(b.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("%d frames, want %d", len(got), len(want))
+		}
+		for i := range want {
+			for j, c := range want[i] {
+				if c != color.RGBAModel.Convert(got[i].At(j%4, j/4)) {
+					t.Errorf("frame %d: pixel %d, %d is %v, want %v", i, j%4, j/4, got[i].At(j%4, j/4), c)
+				}
+			}
+		}
+		if want := []int{100, 200, 300, 400}; len(delays) != 4 || delays[0] != want[0] || delays[1] != want[1] || delays[2] != want[2] || delays[3] != want[3] {
+			t.Errorf("delays %v, want %v", delays, want)
+		}
+		if loop != test.loop {
+			t.Errorf("GIF LoopCount %d: loop %d, want %d", test.loopCount, loop, test.loop)
+		}
+	}
+}
@@ -0,0 +1,751 @@
+// go version go1.7 windows/amd64
+
+// apng combines multiple png files into one apng animation file.
+// See the README for the command line arguments.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/gif"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cvzi/apng"
+)
+
+// Readln returns a single line (without the ending \n)
+// from the input buffered reader.
+// An error is returned iff there is an error with the
+// buffered reader.
+func Readln(r *bufio.Reader) (string, error) {
+	var (
+		isPrefix bool  = true
+		err      error = nil
+		line, ln []byte
+	)
+	for isPrefix && err == nil {
+		line, isPrefix, err = r.ReadLine()
+		ln = append(ln, line...)
+	}
+	return string(ln), err
+}
+
+// repeatedDelay matches the "count x delay" shorthand of a delays file.
+var repeatedDelay = regexp.MustCompile(`^(\d+)\s*x\s*(\d+)$`)
+
+// maxRepeat is the largest count of the "count x delay" shorthand.
+const maxRepeat = 100000
+
+// readDelays reads the frame delays in milliseconds, one per line.
+// A line of the form "10x100" is shorthand for ten frames of 100 ms.
+// Blank lines and lines starting with # are skipped, any other line that
+// is not a delay is an error.
+func readDelays(r *bufio.Reader) ([]int, error) {
+	delays := make([]int, 0)
+	lineno := 0
+	s, err := Readln(r)
+	for err == nil {
+		lineno++
+		s = strings.TrimSpace(s)
+		if m := repeatedDelay.FindStringSubmatch(s); m != nil {
+			count, err1 := strconv.Atoi(m[1])
+			delay, err2 := strconv.Atoi(m[2])
+			if err1 != nil || err2 != nil || count <= 0 || count > maxRepeat || delay <= 0 {
+				return nil, fmt.Errorf("line %d: invalid delay %q, expected count x delay with positive numbers and a count of at most %d", lineno, s, maxRepeat)
+			}
+			for i := 0; i < count; i++ {
+				delays = append(delays, delay)
+			}
+		} else if s != "" && !strings.HasPrefix(s, "#") {
+			delay, err := strconv.Atoi(s)
+			if err != nil || delay < 0 {
+				return nil, fmt.Errorf("line %d: invalid delay %q, expected milliseconds or count x delay", lineno, s)
+			}
+			delays = append(delays, delay)
+		}
+		s, err = Readln(r)
+	}
+	if err != io.EOF {
+		return nil, err
+	}
+	return delays, nil
+}
+
+// readScript reads an animation script: one frame per line as
+// "filename delay [x y [dispose [blend]]]", the delay in milliseconds, x and
+// y the offset of the frame on the canvas. Blank lines and lines starting
+// with # are skipped. Relative filenames are relative to the directory of the
+// script. The delays are returned in milliseconds, o gets the dispose ops and
+// blend ops of the frames and their offsets if any line has x and y.
+func readScript(filename string, o *apng.EncodeOptions) ([]string, []int, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	pngfiles := make([]string, 0)
+	delays := make([]int, 0)
+	var offsets []image.Point
+	var dispose []apng.DisposeOp
+	var blend []apng.BlendOp
+	hasOffsets := false
+	dir := filepath.Dir(filename)
+	r := bufio.NewReader(f)
+	lineno := 0
+	s, err := Readln(r)
+	for err == nil {
+		lineno++
+		s = strings.TrimSpace(s)
+		if s != "" && !strings.HasPrefix(s, "#") {
+			fields := strings.Fields(s)
+			if len(fields) < 2 || len(fields) == 3 || len(fields) > 6 {
+				return nil, nil, fmt.Errorf("line %d: expected filename delay [x y [dispose [blend]]]", lineno)
+			}
+			delay, err := strconv.Atoi(fields[1])
+			if err != nil || delay < 0 {
+				return nil, nil, fmt.Errorf("line %d: invalid delay %q", lineno, fields[1])
+			}
+			var offset image.Point
+			if len(fields) >= 4 {
+				x, errX := strconv.Atoi(fields[2])
+				y, errY := strconv.Atoi(fields[3])
+				if errX != nil || errY != nil {
+					return nil, nil, fmt.Errorf("line %d: invalid offset %q %q", lineno, fields[2], fields[3])
+				}
+				offset = image.Pt(x, y)
+				hasOffsets = true
+			}
+			op := apng.DisposeOpNone
+			if len(fields) >= 5 {
+				var ok bool
+				if op, ok = disposeOps[fields[4]]; !ok {
+					return nil, nil, fmt.Errorf("line %d: invalid dispose %q, use none, background or previous", lineno, fields[4])
+				}
+			}
+			bop := apng.BlendOpSource
+			if len(fields) == 6 {
+				var ok bool
+				if bop, ok = blendOps[fields[5]]; !ok {
+					return nil, nil, fmt.Errorf("line %d: invalid blend %q, use source or over", lineno, fields[5])
+				}
+			}
+			pngfile := fields[0]
+			if !filepath.IsAbs(pngfile) {
+				pngfile = filepath.Join(dir, pngfile)
+			}
+			if _, err := os.Stat(pngfile); err != nil {
+				return nil, nil, fmt.Errorf("line %d: %v", lineno, err)
+			}
+			pngfiles = append(pngfiles, pngfile)
+			delays = append(delays, delay)
+			offsets = append(offsets, offset)
+			dispose = append(dispose, op)
+			blend = append(blend, bop)
+		}
+		s, err = Readln(r)
+	}
+	if err != io.EOF {
+		return nil, nil, err
+	}
+	o.Dispose = dispose
+	o.Blend = blend
+	if hasOffsets {
+		// Only offsets disable the check that the frames have the size of the canvas
+		o.Offsets = offsets
+	}
+	return pngfiles, delays, nil
+}
+
+// sidecar is a JSON delays file, it lists the frames with their delay in
+// milliseconds and optionally the dispose op, blend op and offset:
+//
+//	{"loop": 2, "frames": [{"file": "00.png", "delay": 100, "dispose": "background", "blend": "over", "x": 10, "y": 5}]}
+type sidecar struct {
+	Loop   *int           `json:"loop"`
+	Frames []sidecarFrame `json:"frames"`
+}
+
+type sidecarFrame struct {
+	File    string `json:"file"`
+	Delay   int    `json:"delay"`
+	Dispose string `json:"dispose"`
+	Blend   string `json:"blend"`
+	X       *int   `json:"x"`
+	Y       *int   `json:"y"`
+}
+
+var disposeOps = map[string]apng.DisposeOp{
+	"":           apng.DisposeOpNone,
+	"none":       apng.DisposeOpNone,
+	"background": apng.DisposeOpBackground,
+	"previous":   apng.DisposeOpPrevious,
+}
+
+var blendOps = map[string]apng.BlendOp{
+	"":       apng.BlendOpSource,
+	"source": apng.BlendOpSource,
+	"over":   apng.BlendOpOver,
+}
+
+// readSidecar reads the JSON delays file filename. Relative filenames are
+// relative to the directory of the file. The delays are returned in
+// milliseconds, o gets the dispose ops and blend ops of the frames and their
+// offsets if any frame has x or y.
+func readSidecar(filename string, o *apng.EncodeOptions) ([]string, []int, *int, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var s sidecar
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, nil, nil, err
+	}
+	if s.Loop != nil && *s.Loop < 0 {
+		return nil, nil, nil, fmt.Errorf("invalid loop %d", *s.Loop)
+	}
+
+	dir := filepath.Dir(filename)
+	pngfiles := make([]string, len(s.Frames))
+	delays := make([]int, len(s.Frames))
+	o.Dispose = make([]apng.DisposeOp, len(s.Frames))
+	o.Blend = make([]apng.BlendOp, len(s.Frames))
+	offsets := make([]image.Point, len(s.Frames))
+	hasOffsets := false
+	for i, frame := range s.Frames {
+		if frame.File == "" {
+			return nil, nil, nil, fmt.Errorf("frame %d: no file", i)
+		}
+		if frame.Delay < 0 {
+			return nil, nil, nil, fmt.Errorf("frame %d: invalid delay %d", i, frame.Delay)
+		}
+		dispose, ok := disposeOps[frame.Dispose]
+		if !ok {
+			return nil, nil, nil, fmt.Errorf("frame %d: invalid dispose %q, use none, background or previous", i, frame.Dispose)
+		}
+		blend, ok := blendOps[frame.Blend]
+		if !ok {
+			return nil, nil, nil, fmt.Errorf("frame %d: invalid blend %q, use source or over", i, frame.Blend)
+		}
+		pngfile := frame.File
+		if !filepath.IsAbs(pngfile) {
+			pngfile = filepath.Join(dir, pngfile)
+		}
+		if _, err := os.Stat(pngfile); err != nil {
+			return nil, nil, nil, fmt.Errorf("frame %d: %v", i, err)
+		}
+		pngfiles[i] = pngfile
+		delays[i] = frame.Delay
+		o.Dispose[i] = dispose
+		o.Blend[i] = blend
+		if frame.X != nil {
+			offsets[i].X = *frame.X
+			hasOffsets = true
+		}
+		if frame.Y != nil {
+			offsets[i].Y = *frame.Y
+			hasOffsets = true
+		}
+	}
+	if hasOffsets {
+		// Only offsets disable the check that the frames have the size of the canvas
+		o.Offsets = offsets
+	}
+	return pngfiles, delays, s.Loop, nil
+}
+
+// milliseconds returns the delays ms in milliseconds as durations.
+func milliseconds(ms []int) []time.Duration {
+	durations := make([]time.Duration, len(ms))
+	for i, m := range ms {
+		durations[i] = time.Duration(m) * time.Millisecond
+	}
+	return durations
+}
+
+// isFlagSet reports whether the flag name was given on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// Command line arguments
+var dirname string
+
+func init() {
+	const (
+		defaultDirname = "frames"
+		usage          = "The folder containing the source PNG files, or an animated GIF file to convert"
+	)
+	flag.StringVar(&dirname, "input", defaultDirname, usage)
+	flag.StringVar(&dirname, "i", defaultDirname, usage+"-input (shorthand)")
+}
+
+var delayfile string
+
+func init() {
+	const (
+		defaultDelayfile = "delays.txt"
+		usage            = "A text file containing the duration of each frame in milliseconds. Split by line. A .json file lists the frames with their delay, dispose, blend and offset and replaces -input."
+	)
+	flag.StringVar(&delayfile, "delays", defaultDelayfile, usage)
+	flag.StringVar(&delayfile, "d", defaultDelayfile, "-delays (shorthand)")
+}
+
+var output string
+
+func init() {
+	const (
+		defaultOutput = "output.png"
+		usage         = "The destination file."
+	)
+	flag.StringVar(&output, "output", defaultOutput, usage)
+	flag.StringVar(&output, "o", defaultOutput, "-output (shorthand)")
+}
+
+var script string
+
+func init() {
+	const usage = "A text file listing one frame per line as: filename delay [x y [dispose [blend]]]. The delay is in milliseconds, x and y are the offset of the frame, lines starting with # are comments. Replaces -input and -delays."
+	flag.StringVar(&script, "script", "", usage)
+	flag.StringVar(&script, "s", "", "-script (shorthand)")
+}
+
+var loop int
+var loopForever bool
+
+func init() {
+	flag.IntVar(&loop, "loop", 0, "Number of times to play the animation, 0 is infinite.")
+	flag.BoolVar(&loopForever, "loop-forever", false, "Loop the animation infinitely, same as -loop 0.")
+}
+
+var delay int
+var framerate float64
+
+func init() {
+	flag.IntVar(&delay, "delay", 100, "Delay in milliseconds of the frames that have no delay in -delays.")
+	flag.Float64Var(&framerate, "framerate", 0, "Frames per second of the frames that have no delay in -delays, instead of -delay.")
+}
+
+var staticDefault bool
+
+func init() {
+	flag.BoolVar(&staticDefault, "default", false, "Use the first frame only as the default image that viewers without APNG support show, it is not part of the animation.")
+}
+
+var totalDuration time.Duration
+
+func init() {
+	const usage = "Total duration of the animation, e.g. 5s. It is split evenly across all frames and replaces -delays."
+	flag.DurationVar(&totalDuration, "total-duration", 0, usage)
+}
+
+var strict bool
+
+func init() {
+	flag.BoolVar(&strict, "strict", false, "Split the image data into 8192 byte chunks for viewers that are stricter than the spec, like Safari.")
+}
+
+var mergeDuplicates bool
+
+func init() {
+	flag.BoolVar(&mergeDuplicates, "merge-duplicates", false, "Leave out frames that are the same as the frame before and add their delay to that frame.")
+}
+
+var chunkSize int
+
+func init() {
+	flag.IntVar(&chunkSize, "chunk-size", 0, "Largest size in bytes of the chunks the image data is written in, at least 64. The default is 1 MiB.")
+}
+
+var sortOrder string
+
+func init() {
+	const usage = "Order of the png files in -input: natural (frame2.png before frame10.png), lexical or mtime (oldest first)."
+	flag.StringVar(&sortOrder, "sort", "natural", usage)
+}
+
+var infofile string
+
+func init() {
+	const usage = "Print the dimensions, color type, loop count, frames and duration of a PNG or APNG file and exit."
+	flag.StringVar(&infofile, "info", "", usage)
+}
+
+// naturalLess reports whether a sorts before b when runs of digits are
+// compared by their numeric value, e.g. frame2.png before frame10.png.
+func naturalLess(a, b string) bool {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if isDigit(a[i]) && isDigit(b[j]) {
+			si, sj := i, j
+			for i < len(a) && isDigit(a[i]) {
+				i++
+			}
+			for j < len(b) && isDigit(b[j]) {
+				j++
+			}
+			// Numbers of any length, without leading zeros a longer number is larger
+			x := strings.TrimLeft(a[si:i], "0")
+			y := strings.TrimLeft(b[sj:j], "0")
+			if len(x) != len(y) {
+				return len(x) < len(y)
+			}
+			if x != y {
+				return x < y
+			}
+			continue
+		}
+		if a[i] != b[j] {
+			return a[i] < b[j]
+		}
+		i++
+		j++
+	}
+	if len(a)-i != len(b)-j {
+		return len(a)-i < len(b)-j
+	}
+	// Equal apart from leading zeros, e.g. 01.png and 1.png
+	return a < b
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// fileOrders are the values of -sort
+var fileOrders = map[string]func(a, b os.FileInfo) bool{
+	"natural": func(a, b os.FileInfo) bool {
+		return naturalLess(a.Name(), b.Name())
+	},
+	"lexical": func(a, b os.FileInfo) bool {
+		return a.Name() < b.Name()
+	},
+	"mtime": func(a, b os.FileInfo) bool {
+		return a.ModTime().Before(b.ModTime())
+	},
+}
+
+// fileList sorts the files of a directory with less.
+type fileList struct {
+	files []os.FileInfo
+	less  func(a, b os.FileInfo) bool
+}
+
+func (l fileList) Len() int           { return len(l.files) }
+func (l fileList) Less(i, j int) bool { return l.less(l.files[i], l.files[j]) }
+func (l fileList) Swap(i, j int)      { l.files[i], l.files[j] = l.files[j], l.files[i] }
+
+var colorTypeNames = map[int]string{
+	0: "grayscale",
+	2: "truecolor",
+	3: "indexed",
+	4: "grayscale with alpha",
+	6: "truecolor with alpha",
+}
+
+// printInfo prints a summary of the PNG or APNG file filename to stdout.
+func printInfo(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := apng.DecodeInfo(f)
+	if err != nil {
+		return err
+	}
+	colorType, ok := colorTypeNames[info.ColorType]
+	if !ok {
+		colorType = "unknown"
+	}
+	fmt.Printf("Image dimensions: %d x %d\n", info.Width, info.Height)
+	fmt.Printf("Color type: %d (%s), bit depth: %d\n", info.ColorType, colorType, info.BitDepth)
+	if info.Transparent && !info.HasAlpha {
+		fmt.Printf("Transparency: tRNS chunk\n")
+	}
+	if !info.Animated {
+		fmt.Printf("Not animated\n")
+		return nil
+	}
+	if info.Loop == 0 {
+		fmt.Printf("Loop: infinite\n")
+	} else {
+		fmt.Printf("Loop: %d times\n", info.Loop)
+	}
+	fmt.Printf("Frames: %d\n", info.Frames)
+	fmt.Printf("Duration: %v\n", info.Duration)
+	if info.Duration > 0 {
+		fmt.Printf("Average frame rate: %.2f fps\n", float64(info.Frames)/info.Duration.Seconds())
+	}
+	return nil
+}
+
+// printDimensions prints the dimensions of the png file filename, if it can be read.
+func printDimensions(filename string) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if info, err := apng.DecodeInfo(f); err == nil {
+		fmt.Printf("Image dimensions: %d x %d\n", info.Width, info.Height)
+	}
+}
+
+// printSummary prints the number of frames, animation chunks and loops of the written file filename.
+func printSummary(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := apng.DecodeInfo(f)
+	if err != nil {
+		return err
+	}
+	if !info.Animated {
+		fmt.Printf("Wrote a single frame as a PNG without animation\n")
+		return nil
+	}
+	fmt.Printf("Wrote %d frames split up in %d animation chunks\n", info.Frames, info.AnimationChunks)
+	if info.Loop == 0 {
+		fmt.Printf("Loop: infinite\n")
+	} else {
+		fmt.Printf("Loop: %d times\n", info.Loop)
+	}
+	return nil
+}
+
+// convertGIF writes the animated GIF file input as the APNG file output.
+func convertGIF(input, output string) error {
+	f, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	g, err := gif.DecodeAll(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	w, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	if err := apng.EncodeGIF(w, g); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func main() {
+
+	flag.Parse()
+
+	if infofile != "" {
+		if err := printInfo(infofile); err != nil {
+			log.Fatalf("%s: %v", infofile, err)
+		}
+		return
+	}
+
+	// An animated GIF is converted with its own delays and loop count
+	if strings.EqualFold(filepath.Ext(dirname), ".gif") {
+		fmt.Printf("Converting: %s\n", dirname)
+		if err := convertGIF(dirname, output); err != nil {
+			log.Fatalf("Could not convert %s: %v", dirname, err)
+		}
+		if err := printSummary(output); err != nil {
+			log.Fatalf("Could not read output file %s: %v", output, err)
+		}
+		fmt.Printf("End\n")
+		return
+	}
+
+	less, ok := fileOrders[sortOrder]
+	if !ok {
+		log.Fatalf("Invalid -sort %q: use natural, lexical or mtime", sortOrder)
+	}
+	if loop < 0 {
+		log.Fatalf("Invalid -loop %d: use 0 to loop forever or a positive number of plays", loop)
+	}
+	if loopForever && loop != 0 {
+		log.Fatalf("-loop-forever cannot be combined with -loop %d", loop)
+	}
+	if delay < 0 {
+		log.Fatalf("Invalid -delay %d", delay)
+	}
+	if framerate < 0 {
+		log.Fatalf("Invalid -framerate %v", framerate)
+	}
+	// The delay of the frames without one, a frame rate is not rounded to milliseconds
+	defaultDelay := time.Duration(delay) * time.Millisecond
+	if framerate > 0 {
+		if isFlagSet("delay") {
+			log.Fatalf("-framerate cannot be combined with -delay")
+		}
+		defaultDelay = time.Duration(float64(time.Second) / framerate)
+	}
+	if totalDuration < 0 {
+		log.Fatalf("Invalid -total-duration %v", totalDuration)
+	}
+	if totalDuration > 0 && script != "" {
+		log.Fatalf("-total-duration cannot be combined with -script, the script sets the delays")
+	}
+
+	opts := &apng.EncodeOptions{Loop: loop, StaticDefault: staticDefault}
+	var pngfiles []string
+	var durations []time.Duration
+	if script != "" {
+		var ms []int
+		var err error
+		pngfiles, ms, err = readScript(script, opts)
+		if err != nil {
+			log.Fatalf("%s: %v", script, err)
+		}
+		durations = milliseconds(ms)
+	} else if strings.EqualFold(filepath.Ext(delayfile), ".json") {
+		if totalDuration > 0 {
+			log.Fatalf("-total-duration cannot be combined with a JSON -delays file, the file sets the delays")
+		}
+		var ms []int
+		var err error
+		var sidecarLoop *int
+		pngfiles, ms, sidecarLoop, err = readSidecar(delayfile, opts)
+		if err != nil {
+			log.Fatalf("%s: %v", delayfile, err)
+		}
+		durations = milliseconds(ms)
+		// -loop and -loop-forever take precedence over the loop of the file
+		if sidecarLoop != nil && !isFlagSet("loop") && !loopForever {
+			opts.Loop = *sidecarLoop
+		}
+	} else {
+		// Read the delays
+		readdelays := make([]int, 0)
+		f, err := os.Open(delayfile)
+		if totalDuration > 0 {
+			// All frames get the same delay
+			if err == nil {
+				f.Close()
+			}
+		} else if err != nil {
+			fmt.Printf("error opening file: %v\n", err)
+		} else {
+			ms, err := readDelays(bufio.NewReader(f))
+			f.Close()
+			if err != nil {
+				log.Fatalf("%s: %v", delayfile, err)
+			}
+			for _, i := range ms {
+				readdelays = append(readdelays, i)
+			}
+		}
+
+		// Find all png files
+		list, err := ioutil.ReadDir(dirname)
+		if err != nil {
+			log.Fatalf("ReadDir: Could not read %s", dirname)
+		}
+		sort.Stable(fileList{list, less})
+		durations = milliseconds(readdelays)
+
+		for _, value := range list {
+			if strings.HasSuffix(value.Name(), ".png") {
+				pngfiles = append(pngfiles, dirname+"/"+value.Name())
+				if len(durations) < len(pngfiles) {
+					durations = append(durations, defaultDelay)
+				}
+			}
+		}
+	}
+
+	if strict {
+		opts.Compatibility = apng.Strict
+	}
+	opts.ChunkSize = chunkSize
+	opts.MergeDuplicates = mergeDuplicates
+	var delays []int
+	if totalDuration > 0 {
+		// The default image is not shown in the animation and gets no share
+		// of the duration, a single file is a PNG without animation anyway
+		frames := len(pngfiles)
+		if staticDefault && frames > 1 {
+			frames--
+		}
+		var err error
+		opts.TimeBase, opts.SnapTimeBase, err = apng.EvenTimeBase(totalDuration, frames)
+		if err != nil {
+			log.Fatalf("Invalid -total-duration %v: %v", totalDuration, err)
+		}
+		delays = make([]int, len(pngfiles))
+		for i := range delays {
+			delays[i] = 1
+		}
+	}
+
+	// Each delay gets the exact fraction, e.g. 1/30 s for -framerate 30
+	var fractions []apng.Delay
+	if totalDuration == 0 {
+		var err error
+		fractions, err = apng.DurationDelays(durations)
+		if err != nil {
+			log.Fatalf("Invalid delays: %v", err)
+		}
+	}
+
+	opts.Progress = func(i int, filename string) {
+		if i == 0 {
+			printDimensions(filename)
+		}
+		fmt.Printf("Encoding: %s\n", filename)
+	}
+
+	// Open output file
+	w, err := os.Create(output)
+	if err != nil {
+		log.Fatalf("Could not open output file: %s", output)
+	}
+
+	if totalDuration > 0 {
+		err = apng.EncodeWithOptions(w, pngfiles, delays, opts)
+	} else {
+		err = apng.EncodeDelays(w, pngfiles, fractions, opts)
+	}
+	if err != nil {
+		w.Close()
+		log.Fatalf("Could not encode %s: %v", output, err)
+	}
+
+	// Closing can fail when the last write could not be flushed, the file would be truncated
+	if err := w.Close(); err != nil {
+		log.Fatalf("Could not write output file %s: %v", output, err)
+	}
+
+	if err := printSummary(output); err != nil {
+		log.Fatalf("Could not read output file %s: %v", output, err)
+	}
+
+	fmt.Printf("End\n")
+}
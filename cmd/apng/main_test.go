@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"image"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cvzi/apng"
+)
+
+func TestReadDelays(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []int // nil if it is an error
+	}{
+		{"100\n200\n", []int{100, 200}},
+		{"3x50\n", []int{50, 50, 50}},
+		{" 2 x 40 \n10\n", []int{40, 40, 10}},
+		{"# max\n\n100\r\n", []int{100}},
+		{"0\n", []int{0}},
+		{"max x 2\n", nil},
+		{"0x100\n", nil},
+		{"2x0\n", nil},
+		{"10x\n", nil},
+		{"10x-5\n", nil},
+		{"-3x100\n", nil},
+		{"10x100ms\n", nil},
+		{"-10\n", nil},
+		{"10000000000x1\n", nil},
+		{"100001x1\n", nil},
+	}
+	for _, test := range tests {
+		got, err := readDelays(bufio.NewReader(strings.NewReader(test.input)))
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%q: got %v, want an error", test.input, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.input, err)
+			continue
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%q: got %v, want %v", test.input, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%q: got %v, want %v", test.input, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestReadSidecar(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"0.png", "1.png"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		input   string
+		offsets []image.Point
+	}{
+		{`{"frames": [{"file": "0.png", "delay": 10}, {"file": "1.png", "delay": 20, "blend": "over"}]}`, nil},
+		{`{"frames": [{"file": "0.png", "delay": 10}, {"file": "1.png", "delay": 20, "blend": "over", "y": 3}]}`, []image.Point{{}, {0, 3}}},
+	}
+	for _, test := range tests {
+		filename := filepath.Join(dir, "delays.json")
+		if err := ioutil.WriteFile(filename, []byte(test.input), 0644); err != nil {
+			t.Fatal(err)
+		}
+		o := &apng.EncodeOptions{}
+		pngfiles, delays, _, err := readSidecar(filename, o)
+		if err != nil {
+			t.Errorf("%s: %v", test.input, err)
+			continue
+		}
+		if len(pngfiles) != 2 || len(delays) != 2 || delays[0] != 10 || delays[1] != 20 {
+			t.Errorf("%s: got %v and %v", test.input, pngfiles, delays)
+		}
+		if o.Blend[1] != apng.BlendOpOver {
+			t.Errorf("%s: blend %v", test.input, o.Blend)
+		}
+		if len(o.Offsets) != len(test.offsets) || test.offsets != nil && o.Offsets[1] != test.offsets[1] {
+			t.Errorf("%s: offsets %v, want %v", test.input, o.Offsets, test.offsets)
+		}
+	}
+}
+
+func TestReadScript(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"0.png", "1.png"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		input   string
+		offsets []image.Point
+		dispose apng.DisposeOp
+		blend   apng.BlendOp
+		err     string // the start of the error, empty if there is none
+	}{
+		{"# frames\n0.png 10\n\n1.png 20\n", nil, apng.DisposeOpNone, apng.BlendOpSource, ""},
+		{"0.png 10\n1.png 20 3 4\n", []image.Point{{}, {3, 4}}, apng.DisposeOpNone, apng.BlendOpSource, ""},
+		{"0.png 10 0 0 none\n1.png 20 1 2 background over\n", []image.Point{{}, {1, 2}}, apng.DisposeOpBackground, apng.BlendOpOver, ""},
+		{"0.png 10\n1.png 20 3\n", nil, 0, 0, "line 2:"},
+		{"0.png 10\n1.png 20 a 4\n", nil, 0, 0, "line 2:"},
+		{"0.png 10\n\n1.png 20 3 4 later\n", nil, 0, 0, "line 3:"},
+		{"0.png 10\n1.png 20 3 4 none under\n", nil, 0, 0, "line 2:"},
+		{"0.png 10 0 0 none over more\n", nil, 0, 0, "line 1:"},
+		{"0.png -5\n", nil, 0, 0, "line 1:"},
+	}
+	for _, test := range tests {
+		filename := filepath.Join(dir, "script.txt")
+		if err := ioutil.WriteFile(filename, []byte(test.input), 0644); err != nil {
+			t.Fatal(err)
+		}
+		o := &apng.EncodeOptions{}
+		pngfiles, delays, err := readScript(filename, o)
+		if test.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Errorf("%q: got %v, want an error on %s", test.input, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.input, err)
+			continue
+		}
+		if len(pngfiles) != 2 || pngfiles[1] != filepath.Join(dir, "1.png") || len(delays) != 2 || delays[0] != 10 || delays[1] != 20 {
+			t.Errorf("%q: got %v and %v", test.input, pngfiles, delays)
+		}
+		if len(o.Dispose) != 2 || o.Dispose[1] != test.dispose || len(o.Blend) != 2 || o.Blend[1] != test.blend {
+			t.Errorf("%q: dispose %v and blend %v", test.input, o.Dispose, o.Blend)
+		}
+		if len(o.Offsets) != len(test.offsets) || test.offsets != nil && o.Offsets[1] != test.offsets[1] {
+			t.Errorf("%q: offsets %v, want %v", test.input, o.Offsets, test.offsets)
+		}
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/cvzi/apng
+
+go 1.16